@@ -0,0 +1,210 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/s3sync"
+)
+
+//CheckOpts describes command options
+type CheckOpts struct {
+	ReadData       bool       `long:"read-data" description:"download every chunk and verify its content"`
+	ReadDataSubset percentage `long:"read-data-subset" value-name:"N%" description:"download a random subset of the chunks and verify their content"`
+	Exists         string     `long:"exists" default:"auto" choice:"auto" choice:"list" choice:"head" description:"how to find out which chunks are stored: list the repository once, check each chunk with a HEAD request, or pick whichever is expected to be cheaper"`
+	TransferOpts
+	CodecOpts
+	S3Opts
+}
+
+//Check command
+type Check struct {
+	ui     cli.Ui
+	opts   *CheckOpts
+	parser *flags.Parser
+}
+
+//CheckFactory returns a factory method for the check command
+func CheckFactory() func() (cmd cli.Command, err error) {
+	cmd := &Check{
+		opts: &CheckOpts{},
+		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+	}
+
+	cmd.parser = flags.NewNamedParser("s3sync check <S3> [SNAPSHOT]", flags.Default)
+	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return func() (cli.Command, error) {
+		return cmd, nil
+	}
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Check) Help() string {
+	buf := bytes.NewBuffer(nil)
+	cmd.parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Checks one or, if no snapshot is given, all snapshots and exits with a
+  non-zero status if any of them can't be restored.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Check) Synopsis() string {
+	return "verify that snapshots can be restored"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Check) Run(args []string) int {
+	a, err := cmd.parser.ParseArgs(args)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return 127
+	}
+
+	if err := cmd.DoRun(a); err != nil {
+		cmd.ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+//DoRun is called by run and allows an error to be returned
+func (cmd *Check) DoRun(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("not enough arguments, use --help for more information")
+	}
+
+	s3, err := cmd.opts.CreateS3Client(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	_, codec, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	var ids []s3sync.K
+	if len(args) > 1 {
+		id, err := s3sync.ResolveSnapshot(ctx, s3, args[1])
+		if err != nil {
+			return err
+		}
+
+		ids = append(ids, id)
+	} else if ids, err = s3sync.ListSnapshots(ctx, s3); err != nil {
+		return err
+	}
+
+	manifests, unreadable, keys := getManifests(ctx, s3, codec, ids)
+
+	known, err := listKnown(ctx, cmd.ui, s3, cmd.opts.Exists, int64(len(keys)))
+	if err != nil {
+		return err
+	}
+
+	opts := s3sync.CheckOpts{Limits: cmd.opts.Limits(), Codec: codec, Known: known, ReadData: float64(cmd.opts.ReadDataSubset)}
+	if cmd.opts.ReadData {
+		opts.ReadData = 1
+	}
+
+	res, err := s3sync.Check(ctx, keys, opts, s3)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	damaged := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tCHUNKS\tMISSING\tCORRUPT\tSTATUS")
+	for _, id := range ids {
+		m, ok := manifests[id]
+		if !ok {
+			damaged++
+			fmt.Fprintf(tw, "%x\t-\t-\t-\t%v\n", id, unreadable[id])
+			continue
+		}
+
+		missing, corrupt := 0, 0
+		for _, k := range m.Keys {
+			if res.Missing[k] {
+				missing++
+			} else if res.Damaged(k) {
+				corrupt++
+			}
+		}
+
+		status := "ok"
+		if missing+corrupt > 0 {
+			status = "damaged"
+			damaged++
+		}
+
+		fmt.Fprintf(tw, "%x\t%d\t%d\t%d\t%s\n", id, len(m.Keys), missing, corrupt, status)
+	}
+
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, err := range res.Corrupt {
+		cmd.ui.Warn(err.Error())
+	}
+
+	cmd.ui.Info(fmt.Sprintf("checked %d chunks, read %d, %d missing and %d corrupt",
+		res.Checked, res.Read, len(res.Missing), len(res.Corrupt)))
+	if damaged > 0 {
+		return fmt.Errorf("%d of %d snapshots are damaged", damaged, len(ids))
+	}
+
+	return nil
+}
+
+//getManifests fetches the manifests of the given snapshots and returns the distinct keys
+//they reference. A manifest that can't be read makes its snapshot damaged, which is
+//reported as unreadable so that the other snapshots can still be checked
+func getManifests(ctx context.Context, s3 *s3sync.S3, codec *s3sync.Codec, ids []s3sync.K) (manifests map[s3sync.K]*s3sync.Manifest, unreadable map[s3sync.K]error, keys []s3sync.K) {
+	manifests = map[s3sync.K]*s3sync.Manifest{}
+	unreadable = map[s3sync.K]error{}
+	seen := map[s3sync.K]bool{}
+	for _, id := range ids {
+		m, err := s3sync.GetManifest(ctx, s3, codec, id)
+		if err != nil {
+			unreadable[id] = err
+			continue
+		}
+
+		manifests[id] = m
+		for _, k := range m.Keys {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	return manifests, unreadable, keys
+}
@@ -0,0 +1,220 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dchest/safefile"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/s3sync"
+)
+
+//ExportOpts describes command options
+type ExportOpts struct {
+	Compression string   `long:"compression" default:"auto" choice:"auto" choice:"none" choice:"gzip" choice:"zstd" description:"how to compress the archive, 'auto' picks one by the extension of the file: .tar.gz or .tgz for gzip, .tar.zst or .tzst for zstd"`
+	Excludes    []string `long:"exclude" value-name:"PATTERN" description:"leave out paths that match a gitignore-style pattern, can be repeated"`
+	Includes    []string `long:"include" value-name:"PATTERN" description:"keep paths that match a gitignore-style pattern even if they are excluded, can be repeated. As with gitignore, a path can't be included if a directory above it is excluded"`
+	TransferOpts
+	CacheOpts
+	CodecOpts
+	S3Opts
+}
+
+//Export command
+type Export struct {
+	ui     cli.Ui
+	opts   *ExportOpts
+	parser *flags.Parser
+}
+
+//ExportFactory returns a factory method for the export command
+func ExportFactory() func() (cmd cli.Command, err error) {
+	cmd := &Export{
+		opts: &ExportOpts{},
+		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+	}
+
+	cmd.parser = flags.NewNamedParser("s3sync export <S3> <SNAPSHOT> <FILE|->", flags.Default)
+	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return func() (cli.Command, error) {
+		return cmd, nil
+	}
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Export) Help() string {
+	buf := bytes.NewBuffer(nil)
+	cmd.parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Writes the snapshot of a directory as a tar archive to a file or, if the
+  file is '-', to stdout. The file only appears once it is complete.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Export) Synopsis() string {
+	return "write a snapshot as a tar archive"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Export) Run(args []string) int {
+	a, err := cmd.parser.ParseArgs(args)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return 127
+	}
+
+	if err := cmd.DoRun(a); err != nil {
+		cmd.ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+//DoRun is called by run and allows an error to be returned
+func (cmd *Export) DoRun(args []string) (err error) {
+	if len(args) < 3 {
+		return fmt.Errorf("not enough arguments, use --help for more information")
+	}
+
+	comp, err := exportCompression(cmd.opts.Compression, args[2])
+	if err != nil {
+		return err
+	}
+
+	s3, err := cmd.opts.CreateS3Client(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	_, codec, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	cache, err := cmd.opts.CreateCache()
+	if err != nil {
+		return err
+	}
+
+	id, err := s3sync.ResolveSnapshot(ctx, s3, args[1])
+	if err != nil {
+		return err
+	}
+
+	m, err := s3sync.GetManifest(ctx, s3, codec, id)
+	if err != nil {
+		return err
+	}
+
+	if m.Kind == s3sync.KindStream {
+		return fmt.Errorf("snapshot '%x' holds a raw stream instead of a directory, use 's3sync pull' to write it to stdout", id)
+	} else if m.Kind != s3sync.KindDirectory {
+		return fmt.Errorf("snapshot '%x' is of unknown kind '%s', is s3sync outdated?", id, m.Kind)
+	}
+
+	var out io.Writer = os.Stdout
+	var f *safefile.File
+	if args[2] != "-" {
+		f, err = safefile.Create(args[2], 0666)
+		if err != nil {
+			return fmt.Errorf("failed to create '%s': %v", args[2], err)
+		}
+
+		defer f.Close() //removes the file unless it was committed
+		out = f
+	}
+
+	cw := &countw{w: out}
+	zw, err := comp.NewWriter(cw)
+	if err != nil {
+		return err
+	}
+
+	cmd.ui.Info(fmt.Sprintf("exporting %s (%s:%s) as %s archive", s3.ObjectURL(s3sync.SnapshotName(id)), m.Host, m.Dir, comp))
+
+	ferr := &firstErr{}
+	doneCh := make(chan struct{})
+	pr, pw := io.Pipe()
+	go func() {
+		defer close(doneCh)
+		err := s3sync.Download(ctx, m.Reader(), pw, s3sync.DownloadOpts{Limits: cmd.opts.Limits(), Codec: codec, Cache: cache}, s3)
+		if err != nil {
+			ferr.Set(fmt.Errorf("failed to download: %v", err))
+		}
+
+		pw.CloseWithError(err) //stops the export if the download failed, else signals the end of the stream
+	}()
+
+	skipped := 0
+	if len(cmd.opts.Excludes) > 0 || len(cmd.opts.Includes) > 0 {
+		err = s3sync.FilterTar(pr, zw, s3sync.TarOpts{
+			Excludes: cmd.opts.Excludes,
+			Includes: cmd.opts.Includes,
+			Skipped:  func(rel, why string) { skipped++ },
+		})
+	} else {
+		_, err = io.Copy(zw, pr) //exported exactly as it was stored
+	}
+
+	if err == nil {
+		err = zw.Close()
+	}
+
+	if err != nil {
+		ferr.Set(fmt.Errorf("failed to write archive: %v", err))
+		pr.CloseWithError(err) //stops the download
+	}
+
+	<-doneCh
+	if err = ferr.Err(); err != nil {
+		return err
+	}
+
+	if f != nil {
+		if err = f.Commit(); err != nil {
+			return fmt.Errorf("failed to write '%s': %v", args[2], err)
+		}
+	}
+
+	cmd.ui.Info(fmt.Sprintf("exported %s, %d paths left out", humanBytes(cw.n), skipped))
+	return nil
+}
+
+//exportCompression returns the compression for the archive, by the name of the file if
+//the compression is 'auto'
+func exportCompression(name, file string) (s3sync.Compression, error) {
+	if name != "auto" {
+		return s3sync.ParseCompression(name)
+	}
+
+	switch {
+	case strings.HasSuffix(file, ".gz") || strings.HasSuffix(file, ".tgz"):
+		return s3sync.Gzip, nil
+	case strings.HasSuffix(file, ".zst") || strings.HasSuffix(file, ".tzst"):
+		return s3sync.Zstd, nil
+	default:
+		return s3sync.NoCompression, nil
+	}
+}
@@ -0,0 +1,153 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/s3sync"
+)
+
+//GCOpts describes command options
+type GCOpts struct {
+	Grace      time.Duration `long:"grace" default:"24h" value-name:"24h" description:"never remove snapshots or chunks that are younger than this, it protects pushes that are in progress"`
+	KeepLast   int           `long:"keep-last" value-name:"N" description:"keep the N most recent snapshots and forget older ones, unless kept otherwise"`
+	KeepWithin time.Duration `long:"keep-within" value-name:"DURATION" description:"keep snapshots created within this duration and forget older ones, unless kept otherwise"`
+	DryRun     bool          `long:"dry-run" description:"only report what would be removed"`
+	CodecOpts
+	S3Opts
+}
+
+//GC command
+type GC struct {
+	ui     cli.Ui
+	opts   *GCOpts
+	parser *flags.Parser
+}
+
+//GCFactory returns a factory method for the gc command
+func GCFactory() func() (cmd cli.Command, err error) {
+	cmd := &GC{
+		opts: &GCOpts{},
+		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+	}
+
+	cmd.parser = flags.NewNamedParser("s3sync gc <S3>", flags.Default)
+	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return func() (cli.Command, error) {
+		return cmd, nil
+	}
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *GC) Help() string {
+	buf := bytes.NewBuffer(nil)
+	cmd.parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Tagged snapshots are always kept, all snapshots are kept unless a --keep-*
+  option is given. Chunks that are not referenced by a kept snapshot are removed,
+  unless they are younger than the grace period. Since a push may reuse an old
+  unreferenced chunk, the repository is locked while collecting garbage: gc fails
+  while a push is running and pushes fail while gc is running. A lock that is
+  left behind by a crashed process is ignored once it is 30 minutes old.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *GC) Synopsis() string {
+	return "remove snapshots and unreferenced chunks"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *GC) Run(args []string) int {
+	a, err := cmd.parser.ParseArgs(args)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return 127
+	}
+
+	if err := cmd.DoRun(a); err != nil {
+		cmd.ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+//DoRun is called by run and allows an error to be returned
+func (cmd *GC) DoRun(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("not enough arguments, use --help for more information")
+	}
+
+	s3, err := cmd.opts.CreateS3Client(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	_, codec, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	opts := s3sync.GCOpts{Grace: cmd.opts.Grace, DryRun: cmd.opts.DryRun}
+	if cmd.opts.KeepLast > 0 || cmd.opts.KeepWithin > 0 {
+		opts.Keep = cmd.keep
+	}
+
+	st, err := s3sync.GC(ctx, s3, codec, opts)
+	if err != nil {
+		return err
+	}
+
+	verb := "removed"
+	if cmd.opts.DryRun {
+		verb = "would remove"
+	}
+
+	cmd.ui.Output(fmt.Sprintf("%s %d of %d snapshots (%s) and %d of %d chunks (%s), %d unreferenced chunks are younger than %s",
+		verb, st.Forgotten, st.Snapshots, humanBytes(st.ForgottenBytes),
+		st.Removed, st.Chunks, humanBytes(st.RemovedBytes), st.Young, cmd.opts.Grace))
+	return nil
+}
+
+//keep returns the snapshots that are kept by the --keep-* options
+func (cmd *GC) keep(snapshots map[s3sync.K]*s3sync.Manifest) (keep map[s3sync.K]bool) {
+	ids := []s3sync.K{}
+	for id := range snapshots {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return snapshots[ids[i]].Created.After(snapshots[ids[j]].Created)
+	})
+
+	keep = map[s3sync.K]bool{}
+	for i, id := range ids {
+		if i < cmd.opts.KeepLast || (cmd.opts.KeepWithin > 0 && time.Since(snapshots[id].Created) < cmd.opts.KeepWithin) {
+			keep[id] = true
+		}
+	}
+
+	return keep
+}
@@ -0,0 +1,143 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/s3sync"
+)
+
+//IndexCmdOpts describes command options
+type IndexCmdOpts struct {
+	Reset  bool `long:"reset" description:"forget all known keys"`
+	Verify bool `long:"verify" description:"list the repository and forget keys that are no longer stored"`
+	IndexOpts
+	CodecOpts
+	S3Opts
+}
+
+//Index command
+type Index struct {
+	ui     cli.Ui
+	opts   *IndexCmdOpts
+	parser *flags.Parser
+}
+
+//IndexFactory returns a factory method for the index command
+func IndexFactory() func() (cmd cli.Command, err error) {
+	cmd := &Index{
+		opts: &IndexCmdOpts{},
+		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+	}
+
+	cmd.parser = flags.NewNamedParser("s3sync index <S3>", flags.Default)
+	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return func() (cli.Command, error) {
+		return cmd, nil
+	}
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Index) Help() string {
+	buf := bytes.NewBuffer(nil)
+	cmd.parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  The index remembers which keys are stored in a repository, so that a push
+  doesn't have to ask for every chunk. It is kept in the --index-dir. This is
+  apart from the spool file in which pull and repair keep the local data they
+  reuse, which is written next to their directory or in their --spool-dir.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Index) Synopsis() string {
+	return "inspect, verify or reset the local key index"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Index) Run(args []string) int {
+	a, err := cmd.parser.ParseArgs(args)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return 127
+	}
+
+	if err := cmd.DoRun(a); err != nil {
+		cmd.ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+//DoRun is called by run and allows an error to be returned
+func (cmd *Index) DoRun(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("not enough arguments, use --help for more information")
+	}
+
+	if cmd.opts.NoIndex {
+		return fmt.Errorf("the index is disabled by --no-index")
+	}
+
+	s3, err := cmd.opts.CreateS3Client(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	cfg, _, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	index, err := cmd.opts.OpenIndex(ctx, s3, cfg)
+	if err != nil {
+		return err
+	}
+
+	n := index.Len()
+	if cmd.opts.Reset {
+		if err = index.Reset(); err != nil {
+			return err
+		}
+
+		cmd.ui.Info(fmt.Sprintf("forgot %d keys", n))
+	}
+
+	if cmd.opts.Verify && index.Len() > 0 {
+		var stored map[s3sync.K]bool
+		stored, err = listKnown(ctx, cmd.ui, s3, "list", 0)
+		if err != nil {
+			return err
+		}
+
+		err = index.Retain(func(k s3sync.K) bool { return stored[k] })
+		if err != nil {
+			return err
+		}
+
+		cmd.ui.Info(fmt.Sprintf("forgot %d of %d keys that are no longer stored", n-index.Len(), n))
+	}
+
+	cmd.ui.Output(fmt.Sprintf("%d keys known to be stored in %s", index.Len(), s3.ObjectURL("")))
+	return nil
+}
@@ -0,0 +1,141 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/s3sync"
+	"github.com/restic/chunker"
+)
+
+//InitOpts describes command options
+type InitOpts struct {
+	Compression  string   `long:"compression" default:"none" choice:"none" choice:"gzip" choice:"zstd" description:"how chunks are compressed"`
+	MinChunkSize byteSize `long:"min-chunk-size" default:"512KiB" value-name:"512KiB" description:"minimum size of a chunk"`
+	MaxChunkSize byteSize `long:"max-chunk-size" default:"8MiB" value-name:"8MiB" description:"maximum size of a chunk, at most 8MiB"`
+	Polynomial   string   `long:"polynomial" value-name:"HEX" description:"chunker polynomial to use instead of a random one, e.g to keep deduplicating against existing chunks"`
+	CodecOpts
+	S3Opts
+}
+
+//Init command
+type Init struct {
+	ui     cli.Ui
+	opts   *InitOpts
+	parser *flags.Parser
+}
+
+//InitFactory returns a factory method for the init command
+func InitFactory() func() (cmd cli.Command, err error) {
+	cmd := &Init{
+		opts: &InitOpts{},
+		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+	}
+
+	cmd.parser = flags.NewNamedParser("s3sync init <S3>", flags.Default)
+	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return func() (cli.Command, error) {
+		return cmd, nil
+	}
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Init) Help() string {
+	buf := bytes.NewBuffer(nil)
+	cmd.parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Init) Synopsis() string {
+	return "create a new repository in s3"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Init) Run(args []string) int {
+	a, err := cmd.parser.ParseArgs(args)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return 127
+	}
+
+	if err := cmd.DoRun(a); err != nil {
+		cmd.ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+//DoRun is called by run and allows an error to be returned
+func (cmd *Init) DoRun(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("not enough arguments, use --help for more information")
+	}
+
+	comp, err := s3sync.ParseCompression(cmd.opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	secret, err := cmd.opts.Secret()
+	if err != nil {
+		return err
+	}
+
+	codec, err := s3sync.NewCodec(secret, comp)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := s3sync.NewConfig(codec)
+	if err != nil {
+		return err
+	}
+
+	cfg.MinSize = uint(cmd.opts.MinChunkSize)
+	cfg.MaxSize = uint(cmd.opts.MaxChunkSize)
+	if cmd.opts.Polynomial != "" {
+		pol, err := strconv.ParseUint(strings.TrimPrefix(cmd.opts.Polynomial, "0x"), 16, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse polynomial '%s' as hex: %v", cmd.opts.Polynomial, err)
+		}
+
+		cfg.Polynomial = chunker.Pol(pol)
+	}
+
+	s3, err := cmd.opts.CreateS3Client(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	err = s3sync.PutConfig(ctx, s3, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize repository: %v", err)
+	}
+
+	cmd.ui.Info(fmt.Sprintf("initialized repository at %s (chunks of %s-%s, %s compression, encrypted: %v)",
+		s3.ObjectURL(""), humanBytes(int64(cfg.MinSize)), humanBytes(int64(cfg.MaxSize)), cfg.Compression, cfg.Encrypted))
+	return nil
+}
@@ -0,0 +1,177 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/s3sync"
+)
+
+//LogOpts describes command options
+type LogOpts struct {
+	Tag   string `long:"tag" value-name:"NAME" description:"only show snapshots that carry this tag"`
+	Since string `long:"since" value-name:"TIME" description:"only show snapshots created at or after this time, e.g 2017-01-02 or 48h"`
+	Until string `long:"until" value-name:"TIME" description:"only show snapshots created before this time, e.g 2017-01-02 or 48h"`
+	CodecOpts
+	S3Opts
+}
+
+//Log command
+type Log struct {
+	ui     cli.Ui
+	opts   *LogOpts
+	parser *flags.Parser
+}
+
+//LogFactory returns a factory method for the log command
+func LogFactory() func() (cmd cli.Command, err error) {
+	cmd := &Log{
+		opts: &LogOpts{},
+		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+	}
+
+	cmd.parser = flags.NewNamedParser("s3sync log <S3>", flags.Default)
+	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return func() (cli.Command, error) {
+		return cmd, nil
+	}
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Log) Help() string {
+	buf := bytes.NewBuffer(nil)
+	cmd.parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Log) Synopsis() string {
+	return "list snapshots, newest first"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Log) Run(args []string) int {
+	a, err := cmd.parser.ParseArgs(args)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return 127
+	}
+
+	if err := cmd.DoRun(a); err != nil {
+		cmd.ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+//DoRun is called by run and allows an error to be returned
+func (cmd *Log) DoRun(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("not enough arguments, use --help for more information")
+	}
+
+	var since, until time.Time
+	if cmd.opts.Since != "" {
+		if since, err = parseTime(cmd.opts.Since); err != nil {
+			return err
+		}
+	}
+
+	if cmd.opts.Until != "" {
+		if until, err = parseTime(cmd.opts.Until); err != nil {
+			return err
+		}
+	}
+
+	s3, err := cmd.opts.CreateS3Client(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	_, codec, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	refs, err := s3sync.ListTags(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	tags := map[s3sync.K][]string{}
+	for tag, ref := range refs {
+		tags[ref.Snapshot] = append(tags[ref.Snapshot], tag)
+	}
+
+	ids, err := s3sync.ListSnapshots(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	type snapshot struct {
+		id s3sync.K
+		m  *s3sync.Manifest
+	}
+
+	snapshots := []snapshot{}
+	for _, id := range ids {
+		if cmd.opts.Tag != "" && !hasString(tags[id], cmd.opts.Tag) {
+			continue
+		}
+
+		var m *s3sync.Manifest
+		m, err = s3sync.GetManifest(ctx, s3, codec, id)
+		if err != nil {
+			return err
+		}
+
+		if (!since.IsZero() && m.Created.Before(since)) || (!until.IsZero() && !m.Created.Before(until)) {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot{id, m})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].m.Created.After(snapshots[j].m.Created)
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tCREATED\tHOST\tDIR\tSIZE\tTAGS")
+	for _, s := range snapshots {
+		sort.Strings(tags[s.id])
+		fmt.Fprintf(tw, "%x\t%s\t%s\t%s\t%s\t%s\n",
+			s.id,
+			s.m.Created.Local().Format("2006-01-02 15:04:05"),
+			s.m.Host,
+			s.m.Dir,
+			humanBytes(s.m.Size),
+			strings.Join(tags[s.id], ","))
+	}
+
+	return tw.Flush()
+}
@@ -1,11 +1,17 @@
 package command
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/nerdalize/s3sync/s3sync"
 	"github.com/smartystreets/go-aws-auth"
@@ -15,13 +21,141 @@ import (
 type S3Opts struct {
 	S3Scheme       string `long:"s3-scheme" default:"https" value-name:"https" description:"..."`
 	S3Host         string `long:"s3-host" default:"s3.amazonaws.com" value-name:"s3.amazonaws.com" description:"..."`
+	S3Bucket       string `long:"s3-bucket" value-name:"BUCKET" description:"bucket to use, if empty the host is expected to address the bucket"`
+	S3PathStyle    bool   `long:"s3-path-style" description:"address the bucket in the url path instead of the host name, as used by e.g minio, ceph and localstack"`
 	S3Prefix       string `long:"s3-prefix" description:"..."`
 	S3AccessKey    string `long:"s3-access-key" value-name:"AWS_ACCESS_KEY_ID" description:"..."`
 	S3SecretKey    string `long:"s3-secret-key" value-name:"AWS_SECRET_ACCESS_KEY" description:"..."`
 	S3SessionToken string `long:"s3-session-token" value-name:"AWS_SESSION_TOKEN" description:"..."`
+
+	S3MaxAttempts   int           `long:"s3-max-attempts" default:"5" value-name:"5" description:"nr of attempts for a request that failed transiently, 1 disables retries"`
+	S3RetryDelay    time.Duration `long:"s3-retry-delay" default:"100ms" value-name:"100ms" description:"base delay before retrying a request, doubled on every attempt"`
+	S3MaxRetryDelay time.Duration `long:"s3-max-retry-delay" default:"20s" value-name:"20s" description:"maximum delay between two attempts of a request"`
+}
+
+//TransferOpts configure the resources used for transferring chunks
+type TransferOpts struct {
+	Workers     int      `long:"workers" default:"16" value-name:"16" description:"nr of chunks that are transferred concurrently"`
+	MaxInFlight byteSize `long:"max-in-flight" default:"64MiB" value-name:"64MiB" description:"nr of bytes of chunks, and the buffers they are encoded in, that may be held in memory at once. It is raised to what the largest chunk needs"`
+}
+
+//Limits returns the transfer limits for an upload or download
+func (opts *TransferOpts) Limits() s3sync.Limits {
+	return s3sync.Limits{
+		Workers:     opts.Workers,
+		MaxInFlight: int64(opts.MaxInFlight),
+	}
+}
+
+//CacheOpts configure the local chunk cache
+type CacheOpts struct {
+	CacheDir  string   `long:"cache-dir" value-name:"DIR" description:"directory in which downloaded chunks are cached, can be shared by several processes. The S3SYNC_CACHE_DIR environment variable is used if no directory is given"`
+	CacheSize byteSize `long:"cache-size" default:"1GiB" value-name:"1GiB" description:"size of the cache above which least recently used chunks are evicted"`
+}
+
+//CreateCache opens the configured cache, which is nil if no cache directory is configured
+func (opts *CacheOpts) CreateCache() (c *s3sync.Cache, err error) {
+	dir := opts.CacheDir
+	if dir == "" {
+		dir = os.Getenv("S3SYNC_CACHE_DIR")
+	}
+
+	if dir == "" {
+		return nil, nil
+	}
+
+	return s3sync.OpenCache(dir, int64(opts.CacheSize))
+}
+
+//SpoolOpts configure where local data is kept while it is reused
+type SpoolOpts struct {
+	SpoolDir string `long:"spool-dir" value-name:"DIR" description:"directory in which chunks of local data are kept while they are reused, it needs room for the data of the directory. The parent of the directory is used if no directory is given"`
+}
+
+//IndexOpts configure the local index of keys that are known to be stored
+type IndexOpts struct {
+	IndexDir string `long:"index-dir" value-name:"DIR" description:"directory with the local indexes of known keys, one per repository. The S3SYNC_INDEX_DIR environment variable is used if no directory is given, else the user's cache directory"`
+	NoIndex  bool   `long:"no-index" description:"check the existence of every chunk in the repository instead of consulting the local index"`
+}
+
+//OpenIndex opens the local index for the repository, which is nil if the index is disabled.
+//The index is tagged with the identity and epoch of the repository, so it is started anew
+//when the repository is recreated or chunks were deleted from it.
+func (opts *IndexOpts) OpenIndex(ctx context.Context, s3 *s3sync.S3, cfg *s3sync.Config) (ix *s3sync.Index, err error) {
+	if opts.NoIndex {
+		return nil, nil
+	}
+
+	dir := opts.IndexDir
+	if dir == "" {
+		dir = os.Getenv("S3SYNC_INDEX_DIR")
+	}
+
+	if dir == "" {
+		dir, err = os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine index directory, use --index-dir or --no-index: %v", err)
+		}
+
+		dir = filepath.Join(dir, "s3sync", "index")
+	}
+
+	epoch, err := s3sync.GetEpoch(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%x", sha256.Sum256([]byte(s3.ObjectURL(""))))
+	tag := fmt.Sprintf("%d-%x-%s", cfg.Created.UnixNano(), cfg.Check[:8], epoch)
+	return s3sync.OpenIndex(filepath.Join(dir, name), tag)
+}
+
+//CodecOpts configure how chunks are named and encoded
+type CodecOpts struct {
+	SecretFile string `long:"secret-file" value-name:"FILE" description:"file with the repository secret, required if the repository is encrypted. The S3SYNC_SECRET environment variable is used if no file is given"`
+}
+
+//Secret returns the configured repository secret, which is empty if none is given
+func (opts *CodecOpts) Secret() (secret []byte, err error) {
+	if opts.SecretFile == "" {
+		return []byte(os.Getenv("S3SYNC_SECRET")), nil
+	}
+
+	secret, err = ioutil.ReadFile(opts.SecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret file: %v", err)
+	}
+
+	return bytes.TrimRight(secret, "\r\n"), nil
+}
+
+//OpenRepository reads the repository config and creates the codec it requires, it fails if
+//the repository was not initialized or the secret doesn't match
+func (opts *CodecOpts) OpenRepository(ctx context.Context, s3 *s3sync.S3) (cfg *s3sync.Config, c *s3sync.Codec, err error) {
+	secret, err := opts.Secret()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err = s3sync.GetConfig(ctx, s3)
+	if err == s3sync.ErrNoConfig {
+		return nil, nil, fmt.Errorf("no repository at '%s', use 's3sync init' to create one", s3.ObjectURL(""))
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	c, err = cfg.Codec(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, c, nil
 }
 
-//CreateS3Client uses command line options to create an s3 client
+//CreateS3Client uses command line options to create an s3 client. The endpoint is
+//either a 's3://<bucket>/<prefix>' url, which uses the configured scheme and host, or
+//a http(s) url to the host. With path-style addressing and no explicit bucket the first
+//segment of a http(s) path is taken to be the bucket.
 func (opts *S3Opts) CreateS3Client(ep string) (s3 *s3sync.S3, err error) {
 	loc, err := url.Parse(ep)
 	if err != nil {
@@ -32,14 +166,37 @@ func (opts *S3Opts) CreateS3Client(ep string) (s3 *s3sync.S3, err error) {
 		opts.S3Host = fmt.Sprintf("s3-%s.amazonaws.com", os.Getenv("AWS_REGION"))
 	}
 
-	if loc.Host != "" {
-		opts.S3Host = loc.Host
+	path := strings.Trim(loc.Path, "/")
+	if loc.Scheme == "s3" {
+		if loc.Host == "" {
+			return nil, fmt.Errorf("no bucket in '%s', expected 's3://<bucket>/<prefix>'", ep)
+		}
+
+		opts.S3Bucket = loc.Host
+	} else {
+		if loc.Host != "" {
+			opts.S3Host = loc.Host
+		}
+
+		if loc.Scheme != "" {
+			opts.S3Scheme = loc.Scheme
+		}
+
+		if opts.S3PathStyle && opts.S3Bucket == "" && path != "" {
+			parts := strings.SplitN(path, "/", 2)
+			opts.S3Bucket, path = parts[0], ""
+			if len(parts) > 1 {
+				path = parts[1]
+			}
+		}
 	}
 
-	if loc.Path != "" {
-		opts.S3Prefix = strings.Trim(loc.Path, "/")
+	if path != "" {
+		opts.S3Prefix = path
 	}
 
+	opts.S3Prefix = strings.Trim(opts.S3Prefix, "/") //object urls add their own separators
+
 	if opts.S3AccessKey == "" {
 		opts.S3AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
 	}
@@ -52,14 +209,17 @@ func (opts *S3Opts) CreateS3Client(ep string) (s3 *s3sync.S3, err error) {
 		opts.S3SessionToken = os.Getenv("AWS_SESSION_TOKEN")
 	}
 
-	if loc.Scheme != "" {
-		opts.S3Scheme = loc.Scheme
-	}
-
 	s3 = &s3sync.S3{
-		Scheme: opts.S3Scheme,
-		Host:   opts.S3Host,
-		Prefix: opts.S3Prefix,
+		Scheme:    opts.S3Scheme,
+		Host:      opts.S3Host,
+		Bucket:    opts.S3Bucket,
+		Prefix:    opts.S3Prefix,
+		PathStyle: opts.S3PathStyle,
+		Retry: s3sync.Retry{
+			MaxAttempts: opts.S3MaxAttempts,
+			BaseDelay:   opts.S3RetryDelay,
+			MaxDelay:    opts.S3MaxRetryDelay,
+		},
 		Client: &http.Client{},
 		Creds: awsauth.Credentials{
 			AccessKeyID:     opts.S3AccessKey,
@@ -9,11 +9,16 @@ import (
 	"github.com/nerdalize/s3sync/s3sync"
 	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
-	"github.com/restic/chunker"
 )
 
 //PullOpts describes command options
 type PullOpts struct {
+	NoReuse bool `long:"no-reuse" description:"download every chunk, instead of reusing chunks of data that is already in the directory"`
+	Merge   bool `long:"merge" description:"keep what is in the directory but not in the snapshot, instead of removing it"`
+	SpoolOpts
+	TransferOpts
+	CacheOpts
+	CodecOpts
 	S3Opts
 }
 
@@ -31,7 +36,7 @@ func PullFactory() func() (cmd cli.Command, err error) {
 		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
 	}
 
-	cmd.parser = flags.NewNamedParser("s3sync commit <DIR>", flags.Default)
+	cmd.parser = flags.NewNamedParser("s3sync pull <S3> <SNAPSHOT> <DIR|->", flags.Default)
 	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
 	if err != nil {
 		panic(err)
@@ -52,13 +57,19 @@ func (cmd *Pull) Help() string {
 	return fmt.Sprintf(`
   %s
 
+  Chunks of data that is already in the directory are reused instead of
+  downloaded. They are spooled to a file next to the directory, or in the
+  --spool-dir, while the directory is being overwritten. Afterwards the
+  directory holds exactly what is in the snapshot: files, directories and
+  symlinks that are not in it are removed, unless --merge is given.
+
 %s`, cmd.Synopsis(), buf.String())
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
 // This should be less than 50 characters ideally.
 func (cmd *Pull) Synopsis() string {
-	return "commit and upload a new version of a directory"
+	return "download a snapshot into a directory, or to stdout"
 }
 
 // Run runs the actual command with the given CLI instance and
@@ -81,41 +92,105 @@ func (cmd *Pull) Run(args []string) int {
 
 //DoRun is called by run and allows an error to be returned
 func (cmd *Pull) DoRun(args []string) (err error) {
-	if len(args) < 2 {
+	if len(args) < 3 {
 		return fmt.Errorf("not enough arguments, use --help for more information")
 	}
 
-	fi, err := os.Stat(args[0])
+	s3, err := cmd.opts.CreateS3Client(args[0])
 	if err != nil {
-		return fmt.Errorf("failed to inspect '%s' for commit: %v", args[0], err)
-	} else if !fi.IsDir() {
-		return fmt.Errorf("provided path '%s' is not a directory", args[0])
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	cfg, codec, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
 	}
 
-	s3, err := cmd.opts.CreateS3Client(args[1])
+	cache, err := cmd.opts.CreateCache()
 	if err != nil {
 		return err
 	}
 
-	done := make(chan struct{})
+	id, err := s3sync.ResolveSnapshot(ctx, s3, args[1])
+	if err != nil {
+		return err
+	}
+
+	m, err := s3sync.GetManifest(ctx, s3, codec, id)
+	if err != nil {
+		return err
+	}
+
+	if args[2] == "-" {
+		cmd.ui.Info(fmt.Sprintf("pulling %s (%s:%s) to stdout", s3.ObjectURL(s3sync.SnapshotName(id)), m.Host, m.Dir))
+		err = s3sync.Download(ctx, m.Reader(), os.Stdout, s3sync.DownloadOpts{Limits: cmd.opts.Limits(), Codec: codec, Cache: cache}, s3)
+		if err != nil {
+			return fmt.Errorf("failed to download: %v", err)
+		}
+
+		return nil
+	} else if m.Kind == s3sync.KindStream {
+		return fmt.Errorf("snapshot '%x' holds a raw stream instead of a directory, use '-' to write it to stdout", id)
+	} else if m.Kind != s3sync.KindDirectory {
+		return fmt.Errorf("snapshot '%x' is of unknown kind '%s', is s3sync outdated?", id, m.Kind)
+	}
+
+	err = os.MkdirAll(args[2], 0777)
+	if err != nil {
+		return fmt.Errorf("failed to create directory '%s': %v", args[2], err)
+	}
+
+	fi, err := os.Stat(args[2])
+	if err != nil {
+		return fmt.Errorf("failed to inspect '%s' for pull: %v", args[2], err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("provided path '%s' is not a directory", args[2])
+	}
+
+	cmd.ui.Info(fmt.Sprintf("pulling %s (%s:%s)", s3.ObjectURL(s3sync.SnapshotName(id)), m.Host, m.Dir))
+
+	var local *s3sync.LocalChunks
+	if !cmd.opts.NoReuse {
+		want := map[s3sync.K]bool{}
+		for _, k := range m.Keys {
+			want[k] = true
+		}
+
+		local, err = s3sync.IndexLocal(ctx, args[2], cmd.opts.SpoolDir, cfg, codec, want)
+		if err != nil {
+			cmd.ui.Warn(fmt.Sprintf("failed to index '%s', downloading all chunks: %v", args[2], err))
+		} else {
+			defer local.Close()
+			cmd.ui.Info(fmt.Sprintf("reusing %d of %d chunks from '%s'", local.Len(), len(want), args[2]))
+		}
+	}
+
+	ferr := &firstErr{}
+	doneCh := make(chan struct{})
 	pr, pw := io.Pipe()
-	cr := chunker.New(pr, chunker.Pol(0x3DA3358B4DC173))
 	go func() {
-		err = s3sync.Upload(cr, &stdoutkw{}, 64, s3)
+		defer close(doneCh)
+		err := s3sync.Download(ctx, m.Reader(), pw, s3sync.DownloadOpts{Limits: cmd.opts.Limits(), Codec: codec, Cache: cache, Local: local}, s3)
 		if err != nil {
-			fmt.Println("ERROR", err)
+			ferr.Set(fmt.Errorf("failed to download: %v", err))
 		}
 
-		done <- struct{}{}
+		pw.CloseWithError(err) //stops untar if the download failed, else signals the end of the stream
 	}()
 
-	err = s3sync.Tar(args[0], pw)
+	err = s3sync.Untar(args[2], pr, s3sync.UntarOpts{Prune: !cmd.opts.Merge})
 	if err != nil {
-		return fmt.Errorf("failed to tar '%s': %v", args[0], err)
+		ferr.Set(fmt.Errorf("failed to untar into '%s': %v", args[2], err))
+		pr.CloseWithError(err) //stops the download
 	}
 
-	pw.Close()
-	<-done
+	<-doneCh
+	if err = ferr.Err(); err != nil {
+		return err
+	}
 
 	return nil
 }
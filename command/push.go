@@ -5,15 +5,30 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/nerdalize/s3sync/s3sync"
 	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
-	"github.com/restic/chunker"
 )
 
 //PushOpts describes command options
 type PushOpts struct {
+	Tags   []string `long:"tag" value-name:"NAME" description:"point a tag at the new snapshot, can be repeated"`
+	Exists string   `long:"exists" default:"auto" choice:"auto" choice:"list" choice:"head" description:"how to find out which chunks are stored: list the repository once, check each chunk with a HEAD request, or check chunks one by one while listing the repository as far as the checks pay for it"`
+
+	Excludes    []string `long:"exclude" value-name:"PATTERN" description:"leave out paths that match a gitignore-style pattern, can be repeated. Patterns are also read from '.s3syncignore' files in the directory"`
+	Includes    []string `long:"include" value-name:"PATTERN" description:"archive paths that match a gitignore-style pattern even if they are excluded, can be repeated. As with gitignore, a path can't be included if a directory above it is excluded"`
+	MaxFileSize byteSize `long:"max-file-size" value-name:"SIZE" description:"leave out files that are larger than this, e.g '100MiB'"`
+	ShowSkipped bool     `long:"show-skipped" description:"list every path that was left out"`
+
+	OneFileSystem  bool `long:"one-file-system" description:"leave out the content of directories that are on another file system, such as mount points"`
+	FollowSymlinks bool `long:"follow-symlinks" description:"archive the files and directories that symlinks point to instead of the symlinks themselves"`
+	MaxDepth       int  `long:"max-depth" value-name:"N" description:"leave out the content of directories that are N levels deep, 1 only archives the top level"`
+	TransferOpts
+	IndexOpts
+	CodecOpts
 	S3Opts
 }
 
@@ -31,7 +46,7 @@ func PushFactory() func() (cmd cli.Command, err error) {
 		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
 	}
 
-	cmd.parser = flags.NewNamedParser("s3sync commit <DIR> <S3>", flags.Default)
+	cmd.parser = flags.NewNamedParser("s3sync push <DIR|-> <S3>", flags.Default)
 	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
 	if err != nil {
 		panic(err)
@@ -52,13 +67,16 @@ func (cmd *Push) Help() string {
 	return fmt.Sprintf(`
   %s
 
+  A shared lock is held on the repository while pushing, so no gc removes the
+  chunks that are reused. A push fails while gc is running.
+
 %s`, cmd.Synopsis(), buf.String())
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
 // This should be less than 50 characters ideally.
 func (cmd *Push) Synopsis() string {
-	return "commit and upload a new version of a directory"
+	return "snapshot a directory, or stdin, and upload it to s3"
 }
 
 // Run runs the actual command with the given CLI instance and
@@ -85,11 +103,24 @@ func (cmd *Push) DoRun(args []string) (err error) {
 		return fmt.Errorf("not enough arguments, use --help for more information")
 	}
 
-	fi, err := os.Stat(args[0])
-	if err != nil {
-		return fmt.Errorf("failed to inspect '%s' for commit: %v", args[0], err)
-	} else if !fi.IsDir() {
-		return fmt.Errorf("provided path '%s' is not a directory", args[0])
+	stream := args[0] == "-"
+	if !stream {
+		fi, err := os.Stat(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to inspect '%s' for commit: %v", args[0], err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("provided path '%s' is not a directory", args[0])
+		}
+	}
+
+	for _, tag := range cmd.opts.Tags {
+		if err = s3sync.ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+
+	if cmd.opts.MaxDepth < 0 {
+		return fmt.Errorf("max depth can't be negative, got %d", cmd.opts.MaxDepth)
 	}
 
 	s3, err := cmd.opts.CreateS3Client(args[1])
@@ -97,24 +128,138 @@ func (cmd *Push) DoRun(args []string) (err error) {
 		return err
 	}
 
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	cfg, codec, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	//chunks that exist are reused, they must not be removed by a gc until the manifest
+	//that refers to them is stored
+	lock, err := s3sync.LockRepository(ctx, s3, false)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			cmd.ui.Warn(err.Error())
+		}
+	}()
+
+	index, err := cmd.opts.OpenIndex(ctx, s3, cfg)
+	if err != nil {
+		return err
+	}
+
+	//the nr of chunks isn't known until the data is read, in auto mode the repository is
+	//listed at the pace of the upload instead
+	var known map[s3sync.K]bool
+	var lister *s3sync.KeyLister
+	if cmd.opts.Exists == "auto" {
+		lister = s3sync.ListKeysLazily(ctx, s3)
+		defer lister.Close()
+	} else if known, err = listKnown(ctx, cmd.ui, s3, cmd.opts.Exists, 0); err != nil {
+		return err
+	}
+
+	m := &s3sync.Manifest{Created: time.Now(), Dir: args[0]}
+	if stream {
+		m.Kind = s3sync.KindStream
+	} else if m.Dir, err = filepath.Abs(args[0]); err != nil {
+		return fmt.Errorf("failed to determine absolute path of '%s': %v", args[0], err)
+	}
+
+	m.Host, err = os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to determine hostname: %v", err)
+	}
+
 	cmd.ui.Info(fmt.Sprintf("pushing to %s", s3.KeyURL(s3sync.ZeroKey[:])))
 
-	doneCh := make(chan error)
+	st := &s3sync.UploadStats{}
+	ferr := &firstErr{}
+	doneCh := make(chan struct{})
 	pr, pw := io.Pipe()
-	cr := chunker.New(pr, chunker.Pol(0x3DA3358B4DC173))
+	cr := cfg.Chunker(pr)
 	go func() {
-		doneCh <- s3sync.Upload(cr, &stdoutkw{}, 64, s3)
+		defer close(doneCh)
+		err := s3sync.Upload(ctx, cr, m, s3sync.UploadOpts{Limits: cmd.opts.Limits(), Codec: codec, Index: index, Known: known, Lister: lister, Stats: st}, s3)
+		if err != nil {
+			ferr.Set(fmt.Errorf("failed to upload: %v", err))
+			pr.CloseWithError(err) //stops the tar writer
+		}
 	}()
 
-	err = s3sync.Tar(args[0], pw)
-	if err != nil {
-		return fmt.Errorf("failed to tar '%s': %v", args[0], err)
+	skipped := 0
+	topts := s3sync.TarOpts{
+		Excludes:       cmd.opts.Excludes,
+		Includes:       cmd.opts.Includes,
+		MaxFileSize:    int64(cmd.opts.MaxFileSize),
+		OneFileSystem:  cmd.opts.OneFileSystem,
+		FollowSymlinks: cmd.opts.FollowSymlinks,
+		MaxDepth:       cmd.opts.MaxDepth,
+	}
+
+	topts.Skipped = func(rel, why string) {
+		skipped++
+		if cmd.opts.ShowSkipped {
+			cmd.ui.Info(fmt.Sprintf("skipped %s (%s)", rel, why))
+		}
+	}
+
+	cw := &countw{w: pw}
+	if stream {
+		_, err = io.Copy(cw, os.Stdin)
+		if err != nil {
+			ferr.Set(fmt.Errorf("failed to read from stdin: %v", err))
+		}
+	} else {
+		err = s3sync.Tar(ctx, args[0], cw, topts)
+		if err != nil {
+			ferr.Set(fmt.Errorf("failed to tar '%s': %v", args[0], err))
+		}
 	}
 
-	pw.Close()
-	err = <-doneCh
+	pw.CloseWithError(err) //stops the upload if tar failed, else signals the end of the stream
+	<-doneCh
+	if lister != nil {
+		if err = lister.Close(); err != nil { //chunks were checked one by one instead
+			cmd.ui.Warn(err.Error())
+		}
+	}
+
+	if index != nil {
+		if err = index.Flush(); err != nil { //keys that were stored are known, even if the upload failed
+			ferr.Set(err)
+		}
+	}
+
+	if err = ferr.Err(); err != nil {
+		return err
+	}
+
+	if skipped > 0 && !cmd.opts.ShowSkipped {
+		cmd.ui.Info(fmt.Sprintf("left out %d paths, use --show-skipped to list them", skipped))
+	}
+
+	cmd.ui.Info(fmt.Sprintf("uploaded %d of %d chunks (%d known from the index), %s stored as %s (ratio %.3f)",
+		st.Uploaded, st.Chunks, st.Indexed, humanBytes(st.UploadedBytes), humanBytes(st.StoredBytes), st.Ratio()))
+
+	m.Size = cw.n
+	id, err := s3sync.PutManifest(ctx, s3, codec, m)
 	if err != nil {
-		return fmt.Errorf("failed to upload: %v", err)
+		return fmt.Errorf("failed to store snapshot: %v", err)
+	}
+
+	fmt.Fprintf(os.Stdout, "%x\n", id) //the snapshot exists, even if tagging it fails
+	for _, tag := range cmd.opts.Tags {
+		err = s3sync.Tag(ctx, s3, tag, id)
+		if err != nil {
+			return fmt.Errorf("failed to tag snapshot '%x': %v", id, err)
+		}
 	}
 
 	return nil
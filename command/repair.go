@@ -0,0 +1,220 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/s3sync"
+)
+
+//RepairOpts describes command options
+type RepairOpts struct {
+	ReadData       bool       `long:"read-data" description:"download every chunk to find corrupt ones, instead of only missing ones"`
+	ReadDataSubset percentage `long:"read-data-subset" value-name:"N%" description:"download a random subset of the chunks to find corrupt ones"`
+	Exists         string     `long:"exists" default:"auto" choice:"auto" choice:"list" choice:"head" description:"how to find out which chunks are stored: list the repository once, check each chunk with a HEAD request, or pick whichever is expected to be cheaper"`
+	SpoolOpts
+	TransferOpts
+	IndexOpts
+	CodecOpts
+	S3Opts
+}
+
+//Repair command
+type Repair struct {
+	ui     cli.Ui
+	opts   *RepairOpts
+	parser *flags.Parser
+}
+
+//RepairFactory returns a factory method for the repair command
+func RepairFactory() func() (cmd cli.Command, err error) {
+	cmd := &Repair{
+		opts: &RepairOpts{},
+		ui:   &cli.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+	}
+
+	cmd.parser = flags.NewNamedParser("s3sync repair <DIR> <S3>", flags.Default)
+	_, err := cmd.parser.AddGroup("options", "options", cmd.opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return func() (cli.Command, error) {
+		return cmd, nil
+	}
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Repair) Help() string {
+	buf := bytes.NewBuffer(nil)
+	cmd.parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Damaged chunks of all snapshots are stored anew if the directory still holds
+  their data. Exits with a non-zero status if any snapshot remains damaged.
+  The chunks found in the directory are spooled to a file next to it, or in
+  the --spool-dir.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Repair) Synopsis() string {
+	return "re-upload damaged chunks from a directory"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Repair) Run(args []string) int {
+	a, err := cmd.parser.ParseArgs(args)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return 127
+	}
+
+	if err := cmd.DoRun(a); err != nil {
+		cmd.ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+//DoRun is called by run and allows an error to be returned
+func (cmd *Repair) DoRun(args []string) (err error) {
+	if len(args) < 2 {
+		return fmt.Errorf("not enough arguments, use --help for more information")
+	}
+
+	fi, err := os.Stat(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to inspect '%s' for repair: %v", args[0], err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("provided path '%s' is not a directory", args[0])
+	}
+
+	s3, err := cmd.opts.CreateS3Client(args[1])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	cfg, codec, err := cmd.opts.OpenRepository(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	ids, err := s3sync.ListSnapshots(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	manifests, unreadable, keys := getManifests(ctx, s3, codec, ids)
+	known, err := listKnown(ctx, cmd.ui, s3, cmd.opts.Exists, int64(len(keys)))
+	if err != nil {
+		return err
+	}
+
+	opts := s3sync.CheckOpts{Limits: cmd.opts.Limits(), Codec: codec, Known: known, ReadData: float64(cmd.opts.ReadDataSubset)}
+	if cmd.opts.ReadData {
+		opts.ReadData = 1
+	}
+
+	res, err := s3sync.Check(ctx, keys, opts, s3)
+	if err != nil {
+		return err
+	}
+
+	damaged := map[s3sync.K]bool{}
+	damagedKeys := []s3sync.K{}
+	for _, k := range keys {
+		if res.Damaged(k) {
+			damaged[k] = true
+			damagedKeys = append(damagedKeys, k)
+		}
+	}
+
+	repaired := map[s3sync.K]bool{}
+	if len(damagedKeys) > 0 {
+		cmd.ui.Info(fmt.Sprintf("%d chunks are damaged, looking for them in '%s'", len(damagedKeys), args[0]))
+		local, err := s3sync.IndexLocal(ctx, args[0], cmd.opts.SpoolDir, cfg, codec, damaged)
+		if err != nil {
+			return err
+		}
+
+		defer local.Close()
+		repaired, err = s3sync.Repair(ctx, damagedKeys, local, codec, s3)
+		if err != nil {
+			return err
+		}
+	}
+
+	//damaged keys may be known to the local index, which would keep pushes from storing them
+	index, err := cmd.opts.OpenIndex(ctx, s3, cfg)
+	if err != nil {
+		return err
+	}
+
+	if index != nil {
+		err = index.Retain(func(k s3sync.K) bool { return !damaged[k] || repaired[k] })
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	broken := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tDAMAGED\tREPAIRED\tSTATUS")
+	for _, id := range ids {
+		m, ok := manifests[id]
+		if !ok {
+			broken++
+			fmt.Fprintf(tw, "%x\t-\t-\t%v\n", id, unreadable[id])
+			continue
+		}
+
+		nDamaged, nRepaired := 0, 0
+		for _, k := range m.Keys {
+			if damaged[k] {
+				nDamaged++
+			}
+
+			if repaired[k] {
+				nRepaired++
+			}
+		}
+
+		status := "restorable"
+		if nRepaired < nDamaged {
+			status = "damaged"
+			broken++
+		}
+
+		fmt.Fprintf(tw, "%x\t%d\t%d\t%s\n", id, nDamaged, nRepaired, status)
+	}
+
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+
+	cmd.ui.Info(fmt.Sprintf("repaired %d of %d damaged chunks", len(repaired), len(damagedKeys)))
+	if broken > 0 {
+		return fmt.Errorf("%d of %d snapshots remain damaged", broken, len(ids))
+	}
+
+	return nil
+}
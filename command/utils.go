@@ -1,15 +1,159 @@
 package command
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/mitchellh/cli"
 	"github.com/nerdalize/s3sync/s3sync"
 )
 
-type stdoutkw struct{}
+//countw counts the bytes that are written through it
+type countw struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countw) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+//humanBytes formats a nr of bytes for humans
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+//parseTime parses a point in time as a date, a date with time or as a duration
+//that lies in the past
+func parseTime(s string) (t time.Time, err error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return t, fmt.Errorf("failed to parse '%s' as a time, expected a date like '2006-01-02', a date with time or a duration like '48h'", s)
+}
+
+//hasString returns whether the slice contains s
+func hasString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+//interruptible returns a context that is cancelled when the process is asked to stop
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+//firstErr keeps the first of several errors, the others are usually caused by it
+type firstErr struct {
+	mu  sync.Mutex
+	err error
+}
+
+//Set records err if no error was recorded before
+func (fe *firstErr) Set(err error) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	if fe.err == nil {
+		fe.err = err
+	}
+}
+
+//Err returns the first recorded error
+func (fe *firstErr) Err() error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	return fe.err
+}
+
+//byteSize is a flag value for a nr of bytes, it accepts units such as '512KiB' or '1G'
+type byteSize int64
+
+//UnmarshalFlag implements flags.Unmarshaler
+func (bs *byteSize) UnmarshalFlag(value string) error {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size '%s', expected a nr of bytes like '512KiB', '64MiB' or '1G'", value)
+	}
+
+	*bs = byteSize(n * mult)
+	return nil
+}
+
+//listKnown lists the keys that are stored when mode is "list", or when mode is "auto" and
+//listing is expected to be cheaper than checking the existence of n chunks one by one. It
+//returns nil if chunks are to be checked one by one.
+func listKnown(ctx context.Context, ui cli.Ui, s3 *s3sync.S3, mode string, n int64) (known map[s3sync.K]bool, err error) {
+	if mode == "head" {
+		return nil, nil
+	}
+
+	max := -1
+	if mode == "auto" {
+		max = s3sync.ListLimit(n)
+	}
+
+	known, err = s3sync.ListKeys(ctx, s3, max)
+	if err == s3sync.ErrTooManyKeys {
+		ui.Info(fmt.Sprintf("repository holds more than %d objects, checking the existence of chunks one by one", max))
+		return nil, nil
+	}
+
+	return known, err
+}
+
+//percentage is a flag value such as '10%', it holds a fraction from 0 to 1
+type percentage float64
+
+//UnmarshalFlag parses a percentage, the percent sign is optional
+func (p *percentage) UnmarshalFlag(value string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil || f < 0 || f > 100 {
+		return fmt.Errorf("invalid percentage '%s', expected e.g '10%%'", value)
+	}
 
-func (kw *stdoutkw) Write(k s3sync.K) (err error) {
-	_, err = fmt.Fprintf(os.Stdout, "%x\n", k)
-	return err
+	*p = percentage(f / 100)
+	return nil
 }
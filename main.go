@@ -18,7 +18,16 @@ func main() {
 	c := cli.NewCLI(name, version)
 	c.Args = os.Args[1:]
 	c.Commands = map[string]cli.CommandFactory{
-		"push": command.PushFactory(),
+		"init":      command.InitFactory(),
+		"index":     command.IndexFactory(),
+		"push":      command.PushFactory(),
+		"pull":      command.PullFactory(),
+		"log":       command.LogFactory(),
+		"snapshots": command.LogFactory(),
+		"gc":        command.GCFactory(),
+		"check":     command.CheckFactory(),
+		"repair":    command.RepairFactory(),
+		"export":    command.ExportFactory(),
 	}
 
 	status, err := c.Run()
@@ -3,21 +3,31 @@ package main_test
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/s3sync/command"
 	"github.com/nerdalize/s3sync/s3sync"
-	"github.com/dchest/safefile"
 	"github.com/restic/chunker"
 )
 
@@ -199,51 +209,1687 @@ func (kw *keys) Read() (k s3sync.K, err error) {
 	return k, nil
 }
 
-func untardir(dir string, r io.Reader) (err error) {
-	tr := tar.NewReader(r)
-	for {
-		hdr, err := tr.Next()
+//fakeStore is an in-memory store that speaks enough of the S3 api for the client
+type fakeStore struct {
+	*httptest.Server
+	sync.Mutex
+	objs          map[string]*fakeObject //objects by name
+	reqs          []string               //method and path of every request
+	pageSize      int                    //nr of objects per list page
+	noConditional bool                   //conditional writes are answered with 501
+	noBatchDelete bool                   //batch deletes are answered with 501
+
+	//before is called with the lock held for every request, returning true means it
+	//wrote a response itself
+	before func(w http.ResponseWriter, r *http.Request) bool
+}
+
+type fakeObject struct {
+	data []byte
+	etag string
+	mod  time.Time
+}
+
+func newFakeStore() *fakeStore {
+	fs := &fakeStore{objs: map[string]*fakeObject{}, pageSize: 1000}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.handle))
+	return fs
+}
+
+//client returns a client for the store without retries
+func (fs *fakeStore) client() *s3sync.S3 {
+	return &s3sync.S3{
+		Scheme: "http",
+		Host:   strings.TrimPrefix(fs.URL, "http://"),
+		Client: fs.Client(),
+	}
+}
+
+//put stores an object as if it was uploaded at the given time
+func (fs *fakeStore) put(name string, data []byte, mod time.Time) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.objs[name] = &fakeObject{data, fmt.Sprintf(`"%x"`, md5.Sum(data)), mod}
+}
+
+//count returns the nr of requests with the given method
+func (fs *fakeStore) count(method string) (n int) {
+	fs.Lock()
+	defer fs.Unlock()
+	for _, req := range fs.reqs {
+		if strings.HasPrefix(req, method+" ") {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (fs *fakeStore) handle(w http.ResponseWriter, r *http.Request) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.reqs = append(fs.reqs, r.Method+" "+r.URL.RequestURI())
+	if fs.before != nil && fs.before(w, r) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "GET" && q.Get("list-type") == "2":
+		fs.list(w, q.Get("prefix"), q.Get("continuation-token"))
+	case r.Method == "POST" && q.Has("delete"):
+		if fs.noBatchDelete {
+			http.Error(w, "NotImplemented", http.StatusNotImplemented)
+			return
+		}
+
+		req := struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}{}
+		xml.Unmarshal(body, &req)
+		for _, o := range req.Objects {
+			delete(fs.objs, o.Key)
+		}
+
+		fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+	case r.Method == "GET" || r.Method == "HEAD":
+		o, ok := fs.objs[name]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("ETag", o.etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		if r.Method == "GET" {
+			w.Write(o.data)
+		}
+	case r.Method == "PUT":
+		o, ok := fs.objs[name]
+		conditional := r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+		if conditional && fs.noConditional {
+			http.Error(w, "NotImplemented", http.StatusNotImplemented)
+			return
+		} else if m := r.Header.Get("If-Match"); m != "" && (!ok || o.etag != m) {
+			http.Error(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		} else if r.Header.Get("If-None-Match") == "*" && ok {
+			http.Error(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+
+		fs.objs[name] = &fakeObject{body, fmt.Sprintf(`"%x"`, md5.Sum(body)), time.Now()}
+	case r.Method == "DELETE":
+		delete(fs.objs, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "BadRequest", http.StatusBadRequest)
+	}
+}
+
+//list writes a page of objects whose name starts with prefix and sorts after token
+func (fs *fakeStore) list(w http.ResponseWriter, prefix, token string) {
+	names := []string{}
+	for name := range fs.objs {
+		if strings.HasPrefix(name, prefix) && name > token {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	type content struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+		ETag         string
+	}
+
+	page := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string
+	}{}
+
+	for _, name := range names {
+		if len(page.Contents) == fs.pageSize {
+			page.IsTruncated = true
+			page.NextContinuationToken = page.Contents[len(page.Contents)-1].Key
+			break
+		}
+
+		o := fs.objs[name]
+		page.Contents = append(page.Contents, content{name, len(o.data), o.mod.UTC(), o.etag})
+	}
+
+	xml.NewEncoder(w).Encode(page)
+}
+
+func TestTarUntarDirectory(t *testing.T) {
+	dir, _, testfn := testdir(0, t)
+	tarbuf := bytes.NewBuffer(nil)
+	err := s3sync.Tar(context.Background(), dir, tarbuf, s3sync.TarOpts{})
+	if err != nil {
+		t.Fatalf("failed to tar directory: %v", err)
+	}
+
+	outdir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	err = s3sync.Untar(outdir, tarbuf, s3sync.UntarOpts{})
+	if err != nil {
+		t.Fatalf("failed to untar directory: %v", err)
+	}
+
+	testfn(outdir, t)
+}
+
+func TestUntarOutsideDirectory(t *testing.T) {
+	tarbuf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarbuf)
+	err := tw.WriteHeader(&tar.Header{Name: "../escaped.bin", Mode: 0666, Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	tw.Close()
+	outdir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	err = s3sync.Untar(outdir, tarbuf, s3sync.UntarOpts{})
+	uerr, ok := err.(*s3sync.UntarError)
+	if !ok {
+		t.Fatalf("expected an untar error, got: %v", err)
+	}
+
+	if uerr.Name != "../escaped.bin" {
+		t.Fatalf("expected error to name the entry, got: %v", uerr.Name)
+	}
+}
+
+func TestTarUntarSpecialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	testfile(dir, "a.bin", 1*KiB, 1, t)
+	for _, fn := range []func() error{
+		func() error { return os.MkdirAll(filepath.Join(dir, "empty", "nested"), 0755) },
+		func() error { return os.Symlink("a.bin", filepath.Join(dir, "symlink")) },
+		func() error { return os.Link(filepath.Join(dir, "a.bin"), filepath.Join(dir, "hardlink")) },
+		func() error { return os.Chtimes(filepath.Join(dir, "empty"), time.Now(), time.Unix(1000, 0)) },
+	} {
+		if err = fn(); err != nil {
+			t.Fatalf("failed to setup directory: %v", err)
+		}
+	}
+
+	tarbuf := bytes.NewBuffer(nil)
+	err = s3sync.Tar(context.Background(), dir, tarbuf, s3sync.TarOpts{})
+	if err != nil {
+		t.Fatalf("failed to tar directory: %v", err)
+	}
+
+	outdir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(outdir)
+	err = s3sync.Untar(outdir, tarbuf, s3sync.UntarOpts{})
+	if err != nil {
+		t.Fatalf("failed to untar directory: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(outdir, "empty", "nested"))
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("empty directories should be restored, err: %v", err)
+	}
+
+	fi, err = os.Stat(filepath.Join(outdir, "empty"))
+	if err != nil || !fi.ModTime().Equal(time.Unix(1000, 0)) {
+		t.Fatalf("directory modification time should be restored, err: %v", err)
+	}
+
+	target, err := os.Readlink(filepath.Join(outdir, "symlink"))
+	if err != nil || target != "a.bin" {
+		t.Fatalf("symlink should be restored as is, got '%s', err: %v", target, err)
+	}
+
+	fi1, err1 := os.Stat(filepath.Join(outdir, "a.bin"))
+	fi2, err2 := os.Stat(filepath.Join(outdir, "hardlink"))
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		t.Fatalf("hardlink should be restored, errs: %v, %v", err1, err2)
+	}
+}
+
+func TestUntarThroughSymlink(t *testing.T) {
+	tarbuf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarbuf)
+	tw.WriteHeader(&tar.Header{Name: "link", Linkname: os.TempDir(), Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "link/escaped.bin", Mode: 0666, Typeflag: tar.TypeReg})
+	tw.Close()
+
+	outdir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(outdir)
+	err = s3sync.Untar(outdir, tarbuf, s3sync.UntarOpts{})
+	if _, ok := err.(*s3sync.UntarError); !ok {
+		t.Fatalf("expected an untar error, got: %v", err)
+	}
+
+	if _, err = os.Lstat(filepath.Join(os.TempDir(), "escaped.bin")); !os.IsNotExist(err) {
+		t.Fatalf("entry should not be written through a symlink")
+	}
+}
+
+func TestUntarRootEntry(t *testing.T) {
+	tarbuf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarbuf)
+	tw.WriteHeader(&tar.Header{Name: "./", Mode: 0700, Typeflag: tar.TypeDir, ModTime: time.Unix(1000, 0)})
+	tw.WriteHeader(&tar.Header{Name: "./a.bin", Mode: 0666, Typeflag: tar.TypeReg})
+	tw.Close()
+
+	outdir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(outdir)
+	err = s3sync.Untar(outdir, tarbuf, s3sync.UntarOpts{})
+	if err != nil {
+		t.Fatalf("failed to untar an archive with an entry for the directory itself: %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(outdir, "a.bin")); err != nil {
+		t.Fatalf("expected entry to be extracted: %v", err)
+	}
+
+	fi, err := os.Stat(outdir)
+	if err != nil || fi.ModTime().Equal(time.Unix(1000, 0)) {
+		t.Fatalf("directory should keep its own attributes, err: %v", err)
+	}
+}
+
+func TestUntarOverOlderVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	write := func(name string) {
+		err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0666)
+		}
+
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
+			t.Fatalf("failed to write '%s': %v", name, err)
+		}
+	}
 
-			return fmt.Errorf("failed to read next tar header: %v", err)
+	tarv := func() *bytes.Buffer {
+		buf := bytes.NewBuffer(nil)
+		err := s3sync.Tar(context.Background(), dir, buf, s3sync.TarOpts{})
+		if err != nil {
+			t.Fatalf("failed to tar directory: %v", err)
 		}
 
-		path := filepath.Join(dir, hdr.Name)
-		err = os.MkdirAll(filepath.Dir(path), 0777)
+		return buf
+	}
+
+	write("a.bin")
+	write("sub/s.bin")
+	write("gone.bin")
+	write("keep.bin")
+	if err = os.Symlink("sub", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	v1 := tarv()
+	os.RemoveAll(filepath.Join(dir, "a.bin"))
+	os.RemoveAll(filepath.Join(dir, "sub"))
+	os.RemoveAll(filepath.Join(dir, "gone.bin"))
+	os.RemoveAll(filepath.Join(dir, "link"))
+	write("a.bin/x.bin") //file becomes a directory
+	write("link/y.bin")  //symlink becomes a directory
+	write("sub")         //directory becomes a file
+	v2 := tarv()
+
+	for _, c := range []struct {
+		merge bool
+		exp   string
+	}{
+		{false, "a.bin/,a.bin/x.bin,keep.bin,link/,link/y.bin,sub"},
+		{true, "a.bin/,a.bin/x.bin,gone.bin,keep.bin,link/,link/y.bin,sub"},
+	} {
+		outdir, err := ioutil.TempDir("", "s3sync_")
 		if err != nil {
-			return fmt.Errorf("failed to create dirs: %v", err)
+			t.Fatalf("failed to create tempdir: %v", err)
 		}
 
-		f, err := safefile.Create(path, os.FileMode(hdr.Mode))
+		defer os.RemoveAll(outdir)
+		err = s3sync.Untar(outdir, bytes.NewReader(v1.Bytes()), s3sync.UntarOpts{})
 		if err != nil {
-			return fmt.Errorf("failed to create tmp safe file: %v", err)
+			t.Fatalf("failed to untar first version: %v", err)
 		}
 
-		defer f.Close()
-		n, err := io.Copy(f, tr)
+		err = s3sync.Untar(outdir, bytes.NewReader(v2.Bytes()), s3sync.UntarOpts{Prune: !c.merge})
 		if err != nil {
-			return fmt.Errorf("failed to write file content to tmp file: %v", err)
+			t.Fatalf("failed to untar second version over the first, merge: %v: %v", c.merge, err)
+		}
+
+		names := []string{}
+		filepath.Walk(outdir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || path == outdir {
+				return err
+			}
+
+			name, _ := filepath.Rel(outdir, path)
+			name = filepath.ToSlash(name)
+			if fi.IsDir() {
+				name += "/"
+			} else if !fi.Mode().IsRegular() {
+				name += "@"
+			}
+
+			names = append(names, name)
+			return nil
+		})
+
+		if strings.Join(names, ",") != c.exp {
+			t.Fatalf("merge: %v, expected '%s' after untar, got: '%s'", c.merge, c.exp, strings.Join(names, ","))
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(outdir, "sub"))
+		if err != nil || string(data) != "sub" {
+			t.Fatalf("expected file content of second version, got '%s', err: %v", data, err)
+		}
+	}
+}
+
+func TestTarExcludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		".s3syncignore":             "*.tmp\n/build/\n",
+		"a.tmp":                     "",
+		"keep.tmp":                  "",
+		"big.bin":                   strings.Repeat("x", 100),
+		"build/out.bin":             "",
+		"src/build/keep.bin":        "",
+		"src/.s3syncignore":         "!*.tmp\ncache/\n",
+		"src/b.tmp":                 "",
+		"src/cache/c.bin":           "",
+		"node_modules/x/index.js":   "",
+		"src/node_modules/index.js": "",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+
+		if err = ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatalf("failed to write file: %v", err)
 		}
+	}
+
+	skipped := map[string]string{}
+	tarbuf := bytes.NewBuffer(nil)
+	err = s3sync.Tar(context.Background(), dir, tarbuf, s3sync.TarOpts{
+		Excludes:    []string{"node_modules/"},
+		Includes:    []string{"keep.tmp", "node_modules/x/index.js"}, //the latter is below an excluded directory
+		MaxFileSize: 50,
+		Skipped:     func(rel, why string) { skipped[rel] = why },
+	})
+	if err != nil {
+		t.Fatalf("failed to tar directory: %v", err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(tarbuf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+
+		names = append(names, hdr.Name)
+	}
+
+	expected := ".s3syncignore,keep.tmp,src/,src/.s3syncignore,src/b.tmp,src/build/,src/build/keep.bin"
+	if strings.Join(names, ",") != expected {
+		t.Fatalf("expected archive to hold %s, got: %s", expected, strings.Join(names, ","))
+	}
+
+	if len(skipped) != 6 || skipped["big.bin"] != "too large" || skipped["src/cache"] != "excluded" {
+		t.Fatalf("unexpected skipped paths: %v", skipped)
+	}
+}
+
+func TestFilterTar(t *testing.T) {
+	tarbuf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarbuf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a.bin", Mode: 0666, Typeflag: tar.TypeReg, Size: 1},
+		{Name: "cache/", Mode: 0777, Typeflag: tar.TypeDir},
+		{Name: "cache/b.bin", Mode: 0666, Typeflag: tar.TypeReg, Size: 1},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "cache/b.bin"},
+		{Name: "z.bin", Mode: 0666, Typeflag: tar.TypeReg, Size: 1},
+	} {
+		tw.WriteHeader(hdr)
+		tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+	}
+
+	tw.Close()
+	out := bytes.NewBuffer(nil)
+	err := s3sync.FilterTar(tarbuf, out, s3sync.TarOpts{Excludes: []string{"cache/"}, Includes: []string{"cache/b.bin"}})
+	if err != nil {
+		t.Fatalf("failed to filter tar: %v", err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+
+		names = append(names, hdr.Name)
+	}
+
+	if strings.Join(names, ",") != "a.bin,z.bin" {
+		t.Fatalf("expected excluded directory and the hardlink into it to be left out, got: %v", names)
+	}
+}
 
-		if n != hdr.Size {
-			return fmt.Errorf("unexpected nr of bytes written, wrote '%d' saw '%d' in tar hdr", n, hdr.Size)
+func TestTarFollowSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	testfile(dir, filepath.Join("data", "a", "b.bin"), 1*KiB, 1, t)
+	for _, fn := range []func() error{
+		func() error { return os.Symlink("data", filepath.Join(dir, "link")) },
+		func() error { return os.Symlink("..", filepath.Join(dir, "data", "a", "loop")) },
+		func() error { return os.Symlink("missing", filepath.Join(dir, "dangling")) },
+	} {
+		if err = fn(); err != nil {
+			t.Fatalf("failed to setup directory: %v", err)
 		}
+	}
 
-		err = f.Commit()
+	entries := func(opts s3sync.TarOpts) (s string) {
+		tarbuf := bytes.NewBuffer(nil)
+		err := s3sync.Tar(context.Background(), dir, tarbuf, opts)
 		if err != nil {
-			return fmt.Errorf("failed to swap old file for tmp file: %v", err)
+			t.Fatalf("failed to tar directory: %v", err)
+		}
+
+		tr := tar.NewReader(tarbuf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return s
+			} else if err != nil {
+				t.Fatalf("failed to read tar: %v", err)
+			}
+
+			s += fmt.Sprintf("%s:%c ", hdr.Name, hdr.Typeflag)
 		}
+	}
+
+	expected := "dangling:2 data/:5 data/a/:5 data/a/b.bin:0 data/a/loop:2 link/:5 link/a/:5 link/a/b.bin:0 link/a/loop:2 "
+	if s := entries(s3sync.TarOpts{FollowSymlinks: true}); s != expected {
+		t.Fatalf("expected entries '%s', got: '%s'", expected, s)
+	}
+
+	expected = "dangling:2 data/:5 link:2 "
+	if s := entries(s3sync.TarOpts{MaxDepth: 1}); s != expected {
+		t.Fatalf("expected entries '%s', got: '%s'", expected, s)
+	}
+}
+
+func TestCodecConvergentEncryption(t *testing.T) {
+	c, err := s3sync.NewCodec([]byte("a-repository-secret-for-testing"), s3sync.NoCompression)
+	if err != nil {
+		t.Fatalf("failed to create codec: %v", err)
+	}
+
+	chunk := randb(1*MiB, 1)
+	obj1, err := c.Encode(nil, chunk)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	obj2, err := c.Encode(nil, chunk)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(obj1, obj2) || c.Key(chunk) != c.Key(chunk) {
+		t.Fatalf("identical chunks should result in identical objects")
+	}
+
+	if bytes.Contains(obj1, chunk[:64]) || c.Key(chunk) == s3sync.K(sha256.Sum256(chunk)) {
+		t.Fatalf("object and key should not reveal the content")
+	}
+
+	dec, err := c.Decode(obj1)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
 
-		err = os.Chtimes(path, time.Now(), hdr.ModTime)
+	if !bytes.Equal(dec, chunk) {
+		t.Fatalf("decoded chunk should equal the original")
+	}
+
+	obj2[10] ^= 0xff
+	_, err = c.Decode(obj2)
+	if err == nil {
+		t.Fatalf("decoding a tampered object should fail")
+	}
+}
+
+func TestCodecCompression(t *testing.T) {
+	plain, err := s3sync.NewCodec(nil, s3sync.NoCompression)
+	if err != nil {
+		t.Fatalf("failed to create codec: %v", err)
+	}
+
+	for _, comp := range []s3sync.Compression{s3sync.Gzip, s3sync.Zstd} {
+		c, err := s3sync.NewCodec(nil, comp)
 		if err != nil {
-			return fmt.Errorf("failed to change times of tmp file: %v", err)
+			t.Fatalf("failed to create codec: %v", err)
+		}
+
+		for _, chunk := range [][]byte{bytes.Repeat([]byte("s3sync"), 100000), randb(1*MiB, 2)} {
+			obj, err := c.Encode(nil, chunk)
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+
+			if len(obj) > len(chunk)+c.Overhead() {
+				t.Fatalf("%s: encoding should not grow a chunk beyond the overhead, got %d bytes", comp, len(obj))
+			}
+
+			dec, err := plain.Decode(obj) //compression is detected on decoding
+			if err != nil {
+				t.Fatalf("%s: failed to decode: %v", comp, err)
+			}
+
+			if !bytes.Equal(dec, chunk) || c.Key(chunk) != plain.Key(chunk) {
+				t.Fatalf("%s: decoded chunk and key should equal the original", comp)
+			}
 		}
 	}
+}
+
+func TestConfigCodec(t *testing.T) {
+	secret := []byte("a-repository-secret-for-testing")
+	c, err := s3sync.NewCodec(secret, s3sync.Zstd)
+	if err != nil {
+		t.Fatalf("failed to create codec: %v", err)
+	}
 
-	return nil
+	cfg, err := s3sync.NewConfig(c)
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+
+	if err = cfg.Validate(); err != nil {
+		t.Fatalf("new config should be valid: %v", err)
+	}
+
+	for _, s := range [][]byte{nil, []byte("another-secret-for-testing")} {
+		if _, err = cfg.Codec(s); err == nil {
+			t.Fatalf("codec with secret '%s' should be refused", s)
+		}
+	}
+
+	c2, err := cfg.Codec(secret)
+	if err != nil {
+		t.Fatalf("codec with the right secret should be accepted: %v", err)
+	}
+
+	if c2.Compression() != s3sync.Zstd || c2.Key([]byte("x")) != c.Key([]byte("x")) {
+		t.Fatalf("codec should be configured as the repository")
+	}
+
+	cfg.Version++
+	if err = cfg.Validate(); err == nil {
+		t.Fatalf("config of another format version should be refused")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync_cache_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	cache, err := s3sync.OpenCache(dir, 3*MiB)
+	if err != nil {
+		t.Fatalf("failed to open cache: %v", err)
+	}
+
+	keys := []s3sync.K{}
+	for i := int64(0); i < 4; i++ {
+		chunk := randb(1*MiB, i)
+		k := s3sync.K(sha256.Sum256(chunk))
+		if err = cache.Put(k, chunk); err != nil {
+			t.Fatalf("failed to put chunk: %v", err)
+		}
+
+		keys = append(keys, k)
+		time.Sleep(10 * time.Millisecond) //distinct modification times
+	}
+
+	if _, ok := cache.Get(keys[0], 2*MiB); ok {
+		t.Fatalf("least recently used chunk should have been evicted")
+	}
+
+	obj, ok := cache.Get(keys[3], 2*MiB)
+	if !ok || s3sync.K(sha256.Sum256(obj)) != keys[3] {
+		t.Fatalf("most recently used chunk should be cached as is")
+	}
+}
+
+func TestIndexLocal(t *testing.T) {
+	dir, _, _ := testdir(3, t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := s3sync.NewConfig(nil)
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+
+	tarbuf := bytes.NewBuffer(nil)
+	err = s3sync.Tar(context.Background(), dir, tarbuf, s3sync.TarOpts{})
+	if err != nil {
+		t.Fatalf("failed to tar directory: %v", err)
+	}
+
+	want := map[s3sync.K]bool{}
+	cr := cfg.Chunker(tarbuf)
+	for {
+		chunk, err := cr.Next(nil)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to chunk: %v", err)
+		}
+
+		want[sha256.Sum256(chunk.Data)] = true
+	}
+
+	spool, err := ioutil.TempDir("", "s3sync_spool_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(spool)
+	want[s3sync.ZeroKey] = true //not available locally
+	lc, err := s3sync.IndexLocal(context.Background(), dir, spool, cfg, nil, want)
+	if err != nil {
+		t.Fatalf("failed to index directory: %v", err)
+	}
+
+	defer lc.Close()
+	if fis, _ := ioutil.ReadDir(spool); len(fis) != 1 {
+		t.Fatalf("expected a spool file in the spool dir, got: %d files", len(fis))
+	}
+
+	if lc.Len() != len(want)-1 {
+		t.Fatalf("expected %d local chunks, got %d", len(want)-1, lc.Len())
+	}
+
+	for k := range want {
+		chunk, ok := lc.Get(k)
+		if ok != (k != s3sync.ZeroKey) || (ok && s3sync.K(sha256.Sum256(chunk)) != k) {
+			t.Fatalf("local chunk '%x' is not as expected", k)
+		}
+	}
+}
+
+func TestIndexPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync_index_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+	ix, err := s3sync.OpenIndex(path, "epoch-1")
+	if err != nil {
+		t.Fatalf("failed to open index: %v", err)
+	}
+
+	k := s3sync.K(sha256.Sum256([]byte("a")))
+	ix.Add(k)
+	if err = ix.Flush(); err != nil {
+		t.Fatalf("failed to flush index: %v", err)
+	}
+
+	ix, err = s3sync.OpenIndex(path, "epoch-1")
+	if err != nil || !ix.Has(k) || ix.Len() != 1 {
+		t.Fatalf("reopened index should know the key, err: %v", err)
+	}
+
+	stale := ix
+	ix, err = s3sync.OpenIndex(path, "epoch-2")
+	if err != nil || ix.Has(k) {
+		t.Fatalf("index of another epoch should be reset, err: %v", err)
+	}
+
+	//a process that still has the index of the previous epoch open
+	k2 := s3sync.K(sha256.Sum256([]byte("b")))
+	stale.Add(k2)
+	if err = stale.Flush(); err != nil {
+		t.Fatalf("failed to flush index: %v", err)
+	}
+
+	ix, err = s3sync.OpenIndex(path, "epoch-2")
+	if err != nil || ix.Has(k2) {
+		t.Fatalf("keys of a stale index should not end up in the reset index, err: %v", err)
+	}
+}
+
+func TestTagCompareAndSwap(t *testing.T) {
+	fs := newFakeStore()
+	defer fs.Close()
+
+	ctx := context.Background()
+	s3 := fs.client()
+	k1, k2, k3 := s3sync.K{1}, s3sync.K{2}, s3sync.K{3}
+	if err := s3sync.Tag(ctx, s3, "prod", k1); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+
+	//another writer moves the tag between every read and write of ours, a few times
+	races := 2
+	fs.before = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == "PUT" && r.Header.Get("If-Match") != "" && races > 0 {
+			races--
+			data, _ := json.Marshal(&s3sync.Ref{Snapshot: k2, Parent: k1})
+			fs.objs[s3sync.RefName("prod")] = &fakeObject{data, fmt.Sprintf(`"race-%d"`, races), time.Now()}
+		}
+
+		return false
+	}
+
+	if err := s3sync.Tag(ctx, s3, "prod", k3); err != nil {
+		t.Fatalf("failed to move tag: %v", err)
+	}
+
+	ref, _, err := s3sync.GetRef(ctx, s3, "prod")
+	if err != nil || ref.Snapshot != k3 || ref.Parent != k2 {
+		t.Fatalf("expected tag to point at the new snapshot with the racing one as its parent, got: %+v, err: %v", ref, err)
+	}
+
+	if n := fs.count("PUT"); n != 4 {
+		t.Fatalf("expected 1 + 3 attempts to write the tag, got %d", n)
+	}
+
+	races = 1000
+	if err = s3sync.Tag(ctx, s3, "prod", k1); err == nil {
+		t.Fatalf("expected tag update to give up when it keeps racing")
+	}
+
+	if n := fs.count("PUT"); n != 4+10 {
+		t.Fatalf("expected a bounded nr of attempts, got %d", n-4)
+	}
+
+	races = 0
+	fs.noConditional = true
+	if err = s3sync.Tag(ctx, s3, "prod", k1); err != nil {
+		t.Fatalf("expected fallback to a plain overwrite: %v", err)
+	}
+
+	ref, _, err = s3sync.GetRef(ctx, s3, "prod")
+	if err != nil || ref.Snapshot != k1 {
+		t.Fatalf("expected overwritten tag to point at the snapshot, got: %+v, err: %v", ref, err)
+	}
+
+	fs.put(s3sync.RefName("huge"), bytes.Repeat([]byte(" "), 1<<20), time.Now())
+	if _, _, err = s3sync.GetRef(ctx, s3, "huge"); err == nil {
+		t.Fatalf("expected an oversized ref to be refused")
+	}
+}
+
+func TestS3ClientURLs(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	for _, c := range []struct {
+		ep        string
+		opts      command.S3Opts
+		bucketURL string
+		objectURL string
+	}{
+		{"s3://bucket", command.S3Opts{}, "https://bucket.s3.amazonaws.com", "https://bucket.s3.amazonaws.com/obj"},
+		{"s3://bucket/prefix", command.S3Opts{}, "https://bucket.s3.amazonaws.com", "https://bucket.s3.amazonaws.com/prefix/obj"},
+		{"s3://bucket/a/b/", command.S3Opts{}, "https://bucket.s3.amazonaws.com", "https://bucket.s3.amazonaws.com/a/b/obj"},
+		{"s3://bucket", command.S3Opts{S3Prefix: "/prefix/"}, "https://bucket.s3.amazonaws.com", "https://bucket.s3.amazonaws.com/prefix/obj"},
+		{"s3://bucket/prefix", command.S3Opts{S3PathStyle: true}, "https://s3.amazonaws.com/bucket", "https://s3.amazonaws.com/bucket/prefix/obj"},
+		{"http://127.0.0.1:9000/bucket", command.S3Opts{S3PathStyle: true}, "http://127.0.0.1:9000/bucket", "http://127.0.0.1:9000/bucket/obj"},
+		{"http://127.0.0.1:9000/bucket/a/b/", command.S3Opts{S3PathStyle: true}, "http://127.0.0.1:9000/bucket", "http://127.0.0.1:9000/bucket/a/b/obj"},
+		{"http://127.0.0.1:9000/prefix", command.S3Opts{S3PathStyle: true, S3Bucket: "bucket"}, "http://127.0.0.1:9000/bucket", "http://127.0.0.1:9000/bucket/prefix/obj"},
+		{"https://bucket.example.com/prefix/", command.S3Opts{}, "https://bucket.example.com", "https://bucket.example.com/prefix/obj"},
+		{"https://example.com", command.S3Opts{S3Bucket: "bucket"}, "https://bucket.example.com", "https://bucket.example.com/obj"},
+	} {
+		opts := c.opts
+		opts.S3Scheme, opts.S3Host = "https", "s3.amazonaws.com" //flag defaults
+		s3, err := opts.CreateS3Client(c.ep)
+		if err != nil {
+			t.Fatalf("failed to create client for '%s': %v", c.ep, err)
+		}
+
+		if s3.BucketURL() != c.bucketURL || s3.ObjectURL("obj") != c.objectURL {
+			t.Errorf("for '%s' %+v expected '%s' and '%s', got: '%s' and '%s'", c.ep, c.opts, c.bucketURL, c.objectURL, s3.BucketURL(), s3.ObjectURL("obj"))
+		}
+	}
+
+	if _, err := (&command.S3Opts{}).CreateS3Client("s3:///prefix"); err == nil {
+		t.Fatalf("expected an error for an s3 url without bucket")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	defer fs.Close()
+	fs.put("a", []byte("a"), time.Now())
+
+	s3 := fs.client()
+	s3.Client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}} //the transport itself retries some requests on reused connections
+	s3.Retry = s3sync.Retry{MaxAttempts: 4, BaseDelay: time.Millisecond}
+
+	//fail answers the next requests with the given answers, and forgets earlier requests
+	fail := func(answers ...func(w http.ResponseWriter)) {
+		fs.Lock()
+		defer fs.Unlock()
+		fs.reqs = nil
+		fs.before = func(w http.ResponseWriter, r *http.Request) bool {
+			if len(answers) == 0 {
+				return false
+			}
+
+			answers[0](w)
+			answers = answers[1:]
+			return true
+		}
+	}
+
+	status := func(code int, after string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			if after != "" {
+				w.Header().Set("Retry-After", after)
+			}
+
+			w.WriteHeader(code)
+		}
+	}
+
+	reset := func(w http.ResponseWriter) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}
+
+	fail(status(500, ""), status(503, ""))
+	resp, err := s3.GetObject(ctx, "a")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected get to succeed after server errors, got: %v %v", resp, err)
+	}
+
+	resp.Body.Close()
+	if n := fs.count("GET"); n != 3 {
+		t.Fatalf("expected 3 attempts, got: %d", n)
+	}
+
+	fail(reset)
+	err = s3.PutObject(ctx, "b", []byte("b"))
+	if err != nil {
+		t.Fatalf("expected put to succeed after a connection reset, got: %v", err)
+	}
+
+	if n := fs.count("PUT"); n != 2 {
+		t.Fatalf("expected 2 attempts, got: %d", n)
+	}
+
+	for _, after := range []func() string{
+		func() string { return "1" },
+		func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) },
+	} {
+		fail(status(503, after()))
+		start := time.Now()
+		has, err := s3.HasObject(ctx, "a")
+		if err != nil || !has {
+			t.Fatalf("expected head to succeed after a 503, got: %v %v", has, err)
+		}
+
+		if d := time.Since(start); d < 900*time.Millisecond {
+			t.Fatalf("expected Retry-After to be honored, retried after: %s", d)
+		}
+	}
+
+	for _, answer := range []func(w http.ResponseWriter){status(503, ""), reset} {
+		fail(answer, answer)
+		err = s3.PutObjectIf(ctx, "c", []byte("c"), "")
+		if err == nil {
+			t.Fatalf("expected conditional put to fail")
+		}
+
+		if n := fs.count("PUT"); n != 1 {
+			t.Fatalf("expected conditional put to be attempted once, got: %d", n)
+		}
+	}
+
+	fail(status(500, ""), status(502, ""), status(504, ""), status(503, ""), status(500, ""))
+	resp, err = s3.GetObject(ctx, "a")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the response of the last attempt, got: %v %v", resp, err)
+	}
+
+	resp.Body.Close()
+	if n := fs.count("GET"); n != 4 {
+		t.Fatalf("expected to give up after 4 attempts, got: %d", n)
+	}
+
+	fail(reset, reset, reset, reset, reset)
+	_, err = s3.HasObject(ctx, "a")
+	if err == nil || !strings.Contains(err.Error(), "failed to perform HEAD request") {
+		t.Fatalf("expected the error of the last attempt, got: %v", err)
+	}
+
+	if n := fs.count("HEAD"); n != 4 {
+		t.Fatalf("expected to give up after 4 attempts, got: %d", n)
+	}
+
+	s3.Retry.MaxDelay = 10 * time.Millisecond
+	fail(status(503, "3600"))
+	start := time.Now()
+	if has, err := s3.HasObject(ctx, "a"); err != nil || !has {
+		t.Fatalf("expected head to succeed after a 503, got: %v %v", has, err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected Retry-After to be capped at the max delay, retried after: %s", d)
+	}
+
+	s3.Retry.MaxDelay = 0
+	fail(status(503, "3600"))
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = s3.GetObject(tctx, "a")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the context error, got: %v", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected to return promptly when cancelled during backoff, took: %s", d)
+	}
+}
+
+func TestDownloadCorruptChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	fs := newFakeStore()
+	defer fs.Close()
+	s3 := fs.client()
+	s3.Retry = s3sync.Retry{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	for _, secret := range [][]byte{nil, []byte("a-repository-secret-for-testing")} {
+		c, err := s3sync.NewCodec(secret, s3sync.NoCompression)
+		if err != nil {
+			t.Fatalf("failed to create codec: %v", err)
+		}
+
+		cache, err := s3sync.OpenCache(filepath.Join(dir, fmt.Sprintf("cache-%t", c.Encrypted())), 3*MiB)
+		if err != nil {
+			t.Fatalf("failed to open cache: %v", err)
+		}
+
+		chunk := randb(64*KiB, 1)
+		k := c.Key(chunk)
+		obj, err := c.Encode(nil, chunk)
+		if err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+
+		tampered := append([]byte{}, obj...)
+		tampered[len(tampered)/2] ^= 0xff
+
+		download := func() (*bytes.Buffer, error) {
+			krw := KeyReadWriter()
+			krw.Write(k)
+			out := bytes.NewBuffer(nil)
+			fs.Lock()
+			fs.reqs = nil
+			fs.Unlock()
+			return out, s3sync.Download(context.Background(), krw, out, s3sync.DownloadOpts{Codec: c, Cache: cache}, s3)
+		}
+
+		fs.put(fmt.Sprintf("%x", k), tampered, time.Now())
+		_, err = download()
+		if cerr, ok := err.(*s3sync.CorruptError); !ok || cerr.K != k {
+			t.Fatalf("expected a corrupt error for '%x', got: %v", k, err)
+		}
+
+		if n := fs.count("GET"); n != 3 {
+			t.Fatalf("expected a corrupt chunk to be fetched 3 times, got: %d", n)
+		}
+
+		if _, ok := cache.Get(k, 1*MiB); ok {
+			t.Fatalf("expected corrupt chunk to not be cached")
+		}
+
+		fs.put(fmt.Sprintf("%x", k), obj, time.Now())
+		if err = cache.Put(k, tampered); err != nil {
+			t.Fatalf("failed to put in cache: %v", err)
+		}
+
+		out, err := download()
+		if err != nil || !bytes.Equal(out.Bytes(), chunk) {
+			t.Fatalf("expected the intact chunk to be downloaded, got: %v", err)
+		}
+
+		if n := fs.count("GET"); n != 1 {
+			t.Fatalf("expected the chunk to be fetched once instead of served from the cache, got: %d", n)
+		}
+
+		if cached, ok := cache.Get(k, 1*MiB); !ok || !bytes.Equal(cached, obj) {
+			t.Fatalf("expected the corrupt cache entry to be replaced by the intact object")
+		}
+	}
+}
+
+func TestKeyLister(t *testing.T) {
+	if n := s3sync.ListLimit(16); n != 1000 {
+		t.Fatalf("expected listing 1000 objects to cost as much as 16 checks, got: %d", n)
+	}
+
+	if n := s3sync.ListLimit(1); n != 62 {
+		t.Fatalf("expected a single check to pay for listing 62 objects, got: %d", n)
+	}
+
+	fs := newFakeStore()
+	defer fs.Close()
+	fs.pageSize = 10
+	for i := 0; i < 50; i++ {
+		fs.put(fmt.Sprintf("%x", sha256.Sum256([]byte{byte(i)})), nil, time.Now())
+	}
+
+	pages := func() (n int) {
+		fs.Lock()
+		defer fs.Unlock()
+		for _, req := range fs.reqs {
+			if strings.Contains(req, "list-type=2") {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	//waitPages waits for the lister to have listed n pages, and checks it doesn't list more
+	waitPages := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); pages() < n && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		if pages() != n {
+			t.Fatalf("expected %d pages to be listed, got: %d", n, pages())
+		}
+	}
+
+	kl := s3sync.ListKeysLazily(context.Background(), fs.client())
+	defer kl.Close()
+	waitPages(1)
+	for i := 0; i < 15; i++ {
+		kl.Seen()
+	}
+
+	waitPages(1)
+	kl.Seen()
+	waitPages(2)
+	if kl.Known() != nil {
+		t.Fatalf("expected no keys to be known before the listing is complete")
+	}
+
+	for i := 0; i < 64; i++ {
+		kl.Seen()
+	}
+
+	waitPages(5)
+	if len(kl.Known()) != 50 {
+		t.Fatalf("expected all 50 keys to be known, got: %d", len(kl.Known()))
+	}
+
+	if err := kl.Close(); err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+
+	fs.Lock()
+	fs.before = func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "InternalError", http.StatusInternalServerError)
+		return true
+	}
+
+	fs.Unlock()
+	kl = s3sync.ListKeysLazily(context.Background(), fs.client())
+	waitPages(6)
+	if err := kl.Close(); err == nil {
+		t.Fatalf("expected a failed listing to be reported")
+	}
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	defer fs.Close()
+	s3 := fs.client()
+	c, err := s3sync.NewCodec(nil, s3sync.NoCompression)
+	if err != nil {
+		t.Fatalf("failed to create codec: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	chunk := func(name string, mod time.Time) s3sync.K {
+		k := s3sync.K(sha256.Sum256([]byte(name)))
+		fs.put(fmt.Sprintf("%x", k), []byte(name), mod)
+		return k
+	}
+
+	snapshot := func(keys ...s3sync.K) s3sync.K {
+		id, err := s3sync.PutManifest(ctx, s3, c, &s3sync.Manifest{Created: old, Keys: keys})
+		if err != nil {
+			t.Fatalf("failed to put manifest: %v", err)
+		}
+
+		fs.Lock()
+		fs.objs[s3sync.SnapshotName(id)].mod = old
+		fs.Unlock()
+		return id
+	}
+
+	kept, tagged, forgotten, unreferenced, young := chunk("kept", old), chunk("tagged", old), chunk("forgotten", old), chunk("unreferenced", old), chunk("young", time.Now())
+	keptID, taggedID, forgottenID := snapshot(kept), snapshot(tagged), snapshot(forgotten)
+	if err = s3sync.Tag(ctx, s3, "release", taggedID); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+
+	//has returns whether the store holds an object for each of the given keys
+	has := func(ids ...s3sync.K) (held string) {
+		fs.Lock()
+		defer fs.Unlock()
+		for _, id := range ids {
+			_, chunk := fs.objs[fmt.Sprintf("%x", id)]
+			_, snapshot := fs.objs[s3sync.SnapshotName(id)]
+			held += fmt.Sprintf("%t", chunk || snapshot)[:1]
+		}
+
+		return held
+	}
+
+	opts := s3sync.GCOpts{
+		Grace:  time.Hour,
+		Keep:   func(map[s3sync.K]*s3sync.Manifest) map[s3sync.K]bool { return map[s3sync.K]bool{keptID: true} },
+		DryRun: true,
+	}
+
+	fs.Lock()
+	fs.reqs = nil
+	fs.Unlock()
+	st, err := s3sync.GC(ctx, s3, c, opts)
+	if err != nil {
+		t.Fatalf("failed to collect garbage: %v", err)
+	}
+
+	if st.Snapshots != 3 || st.Forgotten != 1 || st.Chunks != 5 || st.Referenced != 2 || st.Young != 1 || st.Removed != 2 {
+		t.Fatalf("unexpected gc stats: %+v", st)
+	}
+
+	if n := fs.count("PUT") + fs.count("POST") + fs.count("DELETE"); n != 0 {
+		t.Fatalf("expected a dry run to not change the store, got %d requests that do", n)
+	}
+
+	fs.Lock()
+	fs.reqs, fs.noBatchDelete = nil, true
+	fs.Unlock()
+	opts.DryRun = false
+	if _, err = s3sync.GC(ctx, s3, c, opts); err != nil {
+		t.Fatalf("failed to collect garbage: %v", err)
+	}
+
+	expected := "ttfftttf" //all but the forgotten snapshot and the chunks only it referenced
+	if held := has(kept, tagged, forgotten, unreferenced, young, keptID, taggedID, forgottenID); held != expected {
+		t.Fatalf("expected store to hold '%s', got: '%s'", expected, held)
+	}
+
+	if fs.count("POST") != 2 || fs.count("DELETE") != 4 { //3 objects and the lock
+		t.Fatalf("expected per-object deletes after batch deletes are not implemented, got: %v", fs.reqs)
+	}
+
+	epoch, deleted := -1, -1
+	for i, req := range fs.reqs {
+		if req == "PUT /"+s3sync.EpochName && epoch < 0 {
+			epoch = i
+		} else if (strings.HasPrefix(req, "POST ") || strings.HasPrefix(req, "DELETE ")) && deleted < 0 {
+			deleted = i
+		}
+	}
+
+	if epoch < 0 || epoch > deleted {
+		t.Fatalf("expected a new epoch before anything is deleted, got: %v", fs.reqs)
+	}
+
+	fs.Lock()
+	fs.reqs, fs.noBatchDelete = nil, false
+	fs.Unlock()
+	leftover := chunk("leftover", old)
+	if _, err = s3sync.GC(ctx, s3, c, opts); err != nil {
+		t.Fatalf("failed to collect garbage: %v", err)
+	}
+
+	if has(leftover) != "f" || fs.count("POST") != 1 || fs.count("DELETE") != 1 {
+		t.Fatalf("expected a single batch delete, got: %v", fs.reqs)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fs := newFakeStore()
+	defer fs.Close()
+	s3 := fs.client()
+
+	chunks := map[string][]byte{"intact": randb(64*KiB, 1), "missing": randb(64*KiB, 2), "corrupt": randb(64*KiB, 3)}
+	keys := map[string]s3sync.K{}
+	for name, chunk := range chunks {
+		keys[name] = sha256.Sum256(chunk)
+	}
+
+	fs.put(fmt.Sprintf("%x", keys["intact"]), chunks["intact"], time.Now())
+	fs.put(fmt.Sprintf("%x", keys["corrupt"]), chunks["intact"], time.Now())
+	all := []s3sync.K{keys["intact"], keys["missing"], keys["corrupt"]}
+
+	for _, c := range []struct {
+		opts    s3sync.CheckOpts
+		read    int
+		corrupt bool
+		heads   int
+	}{
+		{s3sync.CheckOpts{}, 0, false, 3}, //a corrupt chunk goes unnoticed without reading it
+		{s3sync.CheckOpts{ReadData: 1}, 2, true, 3},
+		{s3sync.CheckOpts{ReadData: 1, Known: map[s3sync.K]bool{keys["intact"]: true, keys["corrupt"]: true}}, 2, true, 0},
+	} {
+		fs.Lock()
+		fs.reqs = nil
+		fs.Unlock()
+		res, err := s3sync.Check(context.Background(), all, c.opts, s3)
+		if err != nil {
+			t.Fatalf("failed to check: %v", err)
+		}
+
+		if res.Checked != 3 || res.Read != c.read || len(res.Missing) != 1 || !res.Missing[keys["missing"]] {
+			t.Fatalf("expected 3 checked, %d read and only the missing chunk to be missing, got: %+v", c.read, res)
+		}
+
+		if _, ok := res.Corrupt[keys["corrupt"]].(*s3sync.CorruptError); ok != c.corrupt || len(res.Corrupt) != map[bool]int{true: 1}[c.corrupt] {
+			t.Fatalf("expected the corrupt chunk to be reported: %v, got: %v", c.corrupt, res.Corrupt)
+		}
+
+		if res.Damaged(keys["intact"]) || !res.Damaged(keys["missing"]) || res.Damaged(keys["corrupt"]) != c.corrupt {
+			t.Fatalf("unexpected damaged chunks: %+v", res)
+		}
+
+		if n := fs.count("HEAD"); n != c.heads {
+			t.Fatalf("expected %d existence checks, got: %d", c.heads, n)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	dir, _, _ := testdir(4, t)
+	defer os.RemoveAll(dir)
+	fs := newFakeStore()
+	defer fs.Close()
+	s3 := fs.client()
+
+	cfg, err := s3sync.NewConfig(nil)
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+
+	tarbuf := bytes.NewBuffer(nil)
+	err = s3sync.Tar(ctx, dir, tarbuf, s3sync.TarOpts{})
+	if err != nil {
+		t.Fatalf("failed to tar directory: %v", err)
+	}
+
+	krw := KeyReadWriter()
+	err = s3sync.Upload(ctx, cfg.Chunker(tarbuf), krw, s3sync.UploadOpts{}, s3)
+	if err != nil || len(krw.L) < 2 {
+		t.Fatalf("failed to upload more than one chunk, got %d: %v", len(krw.L), err)
+	}
+
+	damaged := krw.L[1]
+	fs.Lock()
+	fs.objs[fmt.Sprintf("%x", damaged)].data[0] ^= 0xff
+	fs.Unlock()
+
+	check := func() *s3sync.CheckResult {
+		res, err := s3sync.Check(ctx, krw.L, s3sync.CheckOpts{ReadData: 1}, s3)
+		if err != nil {
+			t.Fatalf("failed to check: %v", err)
+		}
+
+		return res
+	}
+
+	if res := check(); len(res.Corrupt) != 1 || !res.Damaged(damaged) {
+		t.Fatalf("expected only the damaged chunk to be corrupt, got: %v", res.Corrupt)
+	}
+
+	spool, err := ioutil.TempDir("", "s3sync_spool_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(spool)
+	lc, err := s3sync.IndexLocal(ctx, dir, spool, cfg, nil, map[s3sync.K]bool{damaged: true})
+	if err != nil {
+		t.Fatalf("failed to index directory: %v", err)
+	}
+
+	defer lc.Close()
+	repaired, err := s3sync.Repair(ctx, []s3sync.K{damaged, s3sync.ZeroKey}, lc, nil, s3)
+	if err != nil {
+		t.Fatalf("failed to repair: %v", err)
+	}
+
+	if len(repaired) != 1 || !repaired[damaged] {
+		t.Fatalf("expected only the damaged chunk to be repaired, got: %v", repaired)
+	}
+
+	if res := check(); len(res.Corrupt) != 0 || len(res.Missing) != 0 || res.Read != len(krw.L) {
+		t.Fatalf("expected all chunks to be intact after the repair, got: %+v", res)
+	}
+}
+
+func TestRepositoryLock(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	defer fs.Close()
+	s3 := fs.client()
+	c, err := s3sync.NewCodec(nil, s3sync.NoCompression)
+	if err != nil {
+		t.Fatalf("failed to create codec: %v", err)
+	}
+
+	//a chunk that no snapshot refers to, but that a running push may be reusing
+	k := s3sync.K(sha256.Sum256([]byte("reused")))
+	fs.put(fmt.Sprintf("%x", k), []byte("reused"), time.Now().Add(-2*time.Hour))
+
+	push, err := s3sync.LockRepository(ctx, s3, false)
+	if err != nil {
+		t.Fatalf("failed to take shared lock: %v", err)
+	}
+
+	other, err := s3sync.LockRepository(ctx, s3, false)
+	if err != nil {
+		t.Fatalf("expected shared locks to be taken alongside each other, got: %v", err)
+	}
+
+	if err = other.Unlock(); err != nil {
+		t.Fatalf("failed to unlock: %v", err)
+	}
+
+	if _, err = s3sync.GC(ctx, s3, c, s3sync.GCOpts{}); err == nil {
+		t.Fatalf("expected gc to fail while a push holds a lock")
+	}
+
+	if _, err = s3sync.GC(ctx, s3, c, s3sync.GCOpts{DryRun: true}); err != nil {
+		t.Fatalf("expected a dry run to ignore locks, got: %v", err)
+	}
+
+	fs.Lock()
+	_, held := fs.objs[fmt.Sprintf("%x", k)]
+	n := 0
+	for name := range fs.objs {
+		if strings.HasPrefix(name, s3sync.LockPrefix) {
+			n++
+		}
+	}
+
+	fs.Unlock()
+	if !held || n != 1 {
+		t.Fatalf("expected the chunk and only the lock of the push to be left, chunk: %v, locks: %d", held, n)
+	}
+
+	gc, err := s3sync.LockRepository(ctx, s3, true)
+	if err == nil {
+		t.Fatalf("expected an exclusive lock to fail while a shared lock is held")
+	}
+
+	if err = push.Unlock(); err != nil {
+		t.Fatalf("failed to unlock: %v", err)
+	}
+
+	gc, err = s3sync.LockRepository(ctx, s3, true)
+	if err != nil {
+		t.Fatalf("failed to take exclusive lock: %v", err)
+	}
+
+	if _, err = s3sync.LockRepository(ctx, s3, false); err == nil {
+		t.Fatalf("expected a push to fail while gc holds a lock")
+	}
+
+	//a lock left behind by a crashed process no longer counts
+	fs.Lock()
+	for _, obj := range fs.objs {
+		obj.mod = time.Now().Add(-s3sync.LockStale - time.Minute)
+	}
+
+	fs.Unlock()
+	if _, err = s3sync.GC(ctx, s3, c, s3sync.GCOpts{}); err != nil {
+		t.Fatalf("expected a stale lock to be ignored, got: %v", err)
+	}
+
+	fs.Lock()
+	_, held = fs.objs[fmt.Sprintf("%x", k)]
+	fs.Unlock()
+	if held {
+		t.Fatalf("expected the unreferenced chunk to be removed once no push holds a lock")
+	}
+
+	if err = gc.Unlock(); err != nil {
+		t.Fatalf("failed to unlock: %v", err)
+	}
+}
+
+func TestPipelineLimits(t *testing.T) {
+	data := make([]byte, 192*MiB)
+	rand.New(rand.NewSource(9)).Read(data)
+	pol := chunker.Pol(0x3DA3358B4DC173)
+	objs := map[string][]byte{}
+	cr := chunker.New(bytes.NewReader(data), pol)
+	buf := make([]byte, chunker.MaxSize)
+	for pos := 0; ; {
+		chunk, err := cr.Next(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to chunk: %v", err)
+		}
+
+		objs[fmt.Sprintf("/%x", sha256.Sum256(chunk.Data))] = data[pos : pos+int(chunk.Length)]
+		pos += int(chunk.Length)
+	}
+
+	//the server keeps requests in flight for a while and discards what is uploaded, so
+	//it allocates little itself
+	var mu sync.Mutex
+	var inFlight, peak int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "HEAD":
+			w.WriteHeader(http.StatusNotFound)
+		case "PUT":
+			mu.Lock()
+			if inFlight += r.ContentLength; inFlight > peak {
+				peak = inFlight
+			}
+
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			io.Copy(ioutil.Discard, r.Body)
+			mu.Lock()
+			inFlight -= r.ContentLength
+			mu.Unlock()
+		case "GET":
+			w.Header().Set("Content-Length", strconv.Itoa(len(objs[r.URL.Path])))
+			w.Write(objs[r.URL.Path])
+		}
+	}))
+
+	defer srv.Close()
+	s3 := &s3sync.S3{Scheme: "http", Host: strings.TrimPrefix(srv.URL, "http://"), Client: srv.Client()}
+	lim := s3sync.Limits{Workers: 64, MaxInFlight: 24 * MiB}
+	kw := KeyReadWriter()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := s3sync.Upload(context.Background(), chunker.New(bytes.NewReader(data), pol), kw, s3sync.UploadOpts{Limits: lim}, s3)
+	if err != nil {
+		t.Fatalf("failed to upload: %v", err)
+	}
+
+	//without reuse every chunk and its object would take a buffer of their own
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(data)*3/2) {
+		t.Fatalf("expected upload buffers to be reused, allocated %d bytes for %d bytes of data", alloc, len(data))
+	}
+
+	//every chunk that is put is held alongside the object it is encoded in
+	if peak == 0 || 2*peak > lim.MaxInFlight {
+		t.Fatalf("expected at most %d bytes of objects in flight, got: %d", lim.MaxInFlight/2, peak)
+	}
+
+	runtime.ReadMemStats(&before)
+	err = s3sync.Download(context.Background(), kw, ioutil.Discard, s3sync.DownloadOpts{Limits: lim}, s3)
+	if err != nil {
+		t.Fatalf("failed to download: %v", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(data)/2) {
+		t.Fatalf("expected download buffers to be reused, allocated %d bytes for %d bytes of data", alloc, len(data))
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	fs := newFakeStore()
+	defer fs.Close()
+
+	dir, err := ioutil.TempDir("", "s3sync_")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	defer func() { os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr }()
+
+	//run runs a command with the given data on stdin and returns what it wrote to stdout,
+	//the factory is created once the standard streams are swapped so its ui uses them
+	n := 0
+	run := func(factory func() func() (cli.Command, error), in []byte, args ...string) (code int, out []byte) {
+		n++
+		files := [3]*os.File{}
+		for i := range files {
+			files[i], err = os.Create(filepath.Join(dir, fmt.Sprintf("%d.%d", n, i)))
+			if err != nil {
+				t.Fatalf("failed to create file for standard stream: %v", err)
+			}
+
+			defer files[i].Close()
+		}
+
+		files[0].Write(in)
+		files[0].Seek(0, io.SeekStart)
+		os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+		cmd, _ := factory()()
+		code = cmd.Run(args)
+		os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr
+
+		out, _ = ioutil.ReadFile(files[1].Name())
+		if code != 0 {
+			msg, _ := ioutil.ReadFile(files[2].Name())
+			t.Logf("%s exited with %d: %s", args, code, msg)
+		}
+
+		return code, out
+	}
+
+	if code, _ := run(command.InitFactory, nil, fs.URL); code != 0 {
+		t.Fatalf("failed to init repository")
+	}
+
+	data := randb(3*MiB, 12)
+	code, out := run(command.PushFactory, data, "--no-index", "-", fs.URL)
+	if code != 0 {
+		t.Fatalf("failed to push stream")
+	}
+
+	id := strings.TrimSpace(string(out))
+	code, out = run(command.PullFactory, nil, fs.URL, id, "-")
+	if code != 0 {
+		t.Fatalf("failed to pull stream")
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Fatalf("expected the pulled stream to equal the pushed one, got %d of %d bytes", len(out), len(data))
+	}
+
+	outdir := filepath.Join(dir, "out")
+	if code, _ = run(command.PullFactory, nil, fs.URL, id, outdir); code == 0 {
+		t.Fatalf("expected a stream snapshot to not be pulled into a directory")
+	}
+
+	if _, err = os.Stat(outdir); !os.IsNotExist(err) {
+		t.Fatalf("expected no directory to be created for a stream snapshot, got: %v", err)
+	}
 }
 
 func BenchmarkTarUntarDirectory(b *testing.B) {
@@ -254,7 +1900,7 @@ func BenchmarkTarUntarDirectory(b *testing.B) {
 		b.SetBytes(size)
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			err := s3sync.Tar(dir, tarbuf)
+			err := s3sync.Tar(context.Background(), dir, tarbuf, s3sync.TarOpts{})
 			if err != nil {
 				b.Errorf("failed to tar directory: %v", err)
 			}
@@ -273,7 +1919,7 @@ func BenchmarkTarUntarDirectory(b *testing.B) {
 		b.SetBytes(size)
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			err := untardir(outdir, tarbuf)
+			err := s3sync.Untar(outdir, tarbuf, s3sync.UntarOpts{})
 			if err != nil {
 				b.Errorf("failed to tar directory: %v", err)
 			}
@@ -313,7 +1959,7 @@ func benchmarkUpload(b *testing.B, krw *keys, data []byte, s3 *s3sync.S3) {
 	for i := 0; i < b.N; i++ {
 		r := bytes.NewReader(data)
 		cr := chunker.New(r, chunker.Pol(0x3DA3358B4DC173))
-		err := s3sync.Upload(cr, krw, 64, s3)
+		err := s3sync.Upload(context.Background(), cr, krw, s3sync.UploadOpts{}, s3)
 		if err != nil {
 			b.Error(err)
 		}
@@ -328,7 +1974,7 @@ func benchmarkDownload(b *testing.B, krw *keys, data []byte, output io.Writer, s
 	b.SetBytes(int64(len(data)))
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		err := s3sync.Download(krw, output, 64, s3)
+		err := s3sync.Download(context.Background(), krw, output, s3sync.DownloadOpts{}, s3)
 		if err != nil {
 			b.Error(err)
 		}
@@ -0,0 +1,200 @@
+package s3sync
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/safefile"
+)
+
+//staleTmpAge is the age after which a temporary file in the cache is considered to be
+//left behind by a process that crashed while writing it
+const staleTmpAge = time.Hour
+
+//Cache keeps chunk objects on disk by their key, so that repeated downloads of the same
+//data don't hit the network. Objects are stored as they are in S3, so encrypted chunks are
+//never written to disk in the clear, and are verified against their key whenever they're
+//read. Files are written atomically and the modification time of a file is bumped when it
+//is read, the least recently used files are evicted once the cache grows beyond its maximum
+//size. Several processes can share a cache directory: each of them evicts based on what it
+//finds on disk, and a file that disappears while it is read is simply a cache miss.
+type Cache struct {
+	dir string
+	max int64
+
+	mu       sync.Mutex
+	size     int64 //size of the cache as far as this process knows
+	evicting bool
+}
+
+//OpenCache opens the cache in the given directory, it is created if it doesn't exist
+func OpenCache(dir string, max int64) (c *Cache, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache directory '%s': %v", dir, err)
+	}
+
+	c = &Cache{dir: dir, max: max}
+	files, err := c.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		c.size += fi.Size()
+	}
+
+	return c, nil
+}
+
+//path returns the path of the file for key k, files are spread over subdirectories by
+//their first byte to keep directories small
+func (c *Cache) path(k K) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%02x", k[0]), fmt.Sprintf("%x", k))
+}
+
+//Get returns the object for key k in a pooled buffer, ok is false if it isn't cached or
+//larger than max. The caller is expected to verify the object and Remove it if it's corrupt.
+func (c *Cache) Get(k K, max int) (obj []byte, ok bool) {
+	f, err := os.Open(c.path(k))
+	if err != nil {
+		return nil, false
+	}
+
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Size() > int64(max) {
+		return nil, false
+	}
+
+	obj = pool.get(int(fi.Size()))
+	_, err = io.ReadFull(f, obj)
+	if err != nil {
+		pool.put(obj)
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now) //mark as recently used, it may be gone by now
+	return obj, true
+}
+
+//Put stores the object for key k, it evicts the least recently used objects if the cache
+//grows too large
+func (c *Cache) Put(k K, obj []byte) error {
+	path := c.path(k)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	err = safefile.WriteFile(path, obj, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write '%x' to cache: %v", k, err)
+	}
+
+	c.mu.Lock()
+	c.size += int64(len(obj))
+	evict := c.size > c.max && !c.evicting
+	c.evicting = c.evicting || evict
+	c.mu.Unlock()
+	if !evict {
+		return nil
+	}
+
+	defer func() {
+		c.mu.Lock()
+		c.evicting = false
+		c.mu.Unlock()
+	}()
+
+	return c.evict()
+}
+
+//Remove removes the object for key k, e.g because it turned out to be corrupt
+func (c *Cache) Remove(k K) {
+	os.Remove(c.path(k))
+}
+
+//evict removes the least recently used objects until the cache is below 90% of its
+//maximum size, which keeps it from evicting on every put
+func (c *Cache) evict() error {
+	files, err := c.scan()
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	for _, fi := range files {
+		size += fi.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if size <= c.max/10*9 {
+			break
+		}
+
+		err = os.Remove(c.path(fi.k))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to evict '%x' from cache: %v", fi.k, err)
+		}
+
+		size -= fi.Size()
+	}
+
+	c.mu.Lock()
+	c.size = size
+	c.mu.Unlock()
+	return nil
+}
+
+type cacheFile struct {
+	os.FileInfo
+	k K
+}
+
+//scan lists the objects in the cache, temporary files that were left behind are removed
+func (c *Cache) scan() (files []cacheFile, err error) {
+	dirs, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		fis, err := ioutil.ReadDir(filepath.Join(c.dir, dir.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read cache directory: %v", err)
+		}
+
+		for _, fi := range fis {
+			if strings.HasSuffix(fi.Name(), ".tmp") {
+				if time.Since(fi.ModTime()) > staleTmpAge {
+					os.Remove(filepath.Join(c.dir, dir.Name(), fi.Name()))
+				}
+
+				continue
+			}
+
+			k, err := ParseK(fi.Name())
+			if err != nil || !fi.Mode().IsRegular() {
+				continue //not ours
+			}
+
+			files = append(files, cacheFile{fi, k})
+		}
+	}
+
+	return files, nil
+}
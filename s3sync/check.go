@@ -0,0 +1,121 @@
+package s3sync
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/restic/chunker"
+)
+
+//CheckOpts configures a Check
+type CheckOpts struct {
+	Limits
+	Codec    *Codec     //names and decodes chunks
+	Known    map[K]bool //keys that are stored, e.g as listed by ListKeys. If nil, existence is checked per chunk
+	ReadData float64    //fraction of the chunks that is downloaded and verified against its key, from 0 to 1
+}
+
+//CheckResult describes the chunks that were found to be damaged
+type CheckResult struct {
+	Checked int         //nr of chunks whose existence was checked
+	Read    int         //nr of chunks whose content was verified
+	Missing map[K]bool  //chunks that are not stored
+	Corrupt map[K]error //chunks whose content doesn't match their key
+}
+
+//Damaged returns whether chunk k is missing or corrupt
+func (res *CheckResult) Damaged(k K) bool {
+	_, corrupt := res.Corrupt[k]
+	return res.Missing[k] || corrupt
+}
+
+//Check verifies that the chunks with the given keys are stored and, for a random subset
+//of the given size, that their content matches their key. Damaged chunks are reported in
+//the result, an error is only returned when the check itself couldn't be performed.
+func Check(ctx context.Context, keys []K, opts CheckOpts, s3 *S3) (res *CheckResult, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res = &CheckResult{Missing: map[K]bool{}, Corrupt: map[K]error{}}
+	maxObjectSize := chunker.MaxSize + opts.Codec.Overhead()
+	reserved := maxObjectSize + chunker.MaxSize //with a buffer to decompress into, as for a download
+	lim := opts.Limits.withDefaults(int64(reserved))
+	bud := newBudget(lim.MaxInFlight)
+
+	var mu sync.Mutex
+	ferr := error(nil)
+	work := func(k K, read bool) {
+		exists, err := opts.Known[k], error(nil)
+		if opts.Known == nil {
+			exists, err = s3.Has(ctx, k[:])
+		}
+
+		var chunk []byte
+		if err == nil && exists && read {
+			chunk, err = fetch(ctx, s3, opts.Codec, nil, k, maxObjectSize)
+			pool.put(chunk)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		res.Checked++
+		if _, ok := err.(*CorruptError); ok {
+			res.Read++
+			res.Corrupt[k] = err
+		} else if err != nil {
+			if ferr == nil {
+				ferr = fmt.Errorf("failed to check '%x': %v", k, err)
+				cancel()
+			}
+		} else if !exists {
+			res.Missing[k] = true
+		} else if read {
+			res.Read++
+		}
+	}
+
+	//fixed pool of workers, the budget bounds the memory of chunks that are read
+	type item struct {
+		k    K
+		read bool
+	}
+
+	var wg sync.WaitGroup
+	workCh := make(chan item)
+	for i := 0; i < lim.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range workCh {
+				work(it.k, it.read)
+				if it.read {
+					bud.release(int64(reserved))
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, k := range keys {
+		it := item{k: k, read: opts.ReadData > 0 && rand.Float64() < opts.ReadData}
+		if it.read && bud.acquire(ctx, int64(reserved)) != nil {
+			break
+		}
+
+		select {
+		case workCh <- it:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(workCh)
+	wg.Wait()
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	return res, ctx.Err()
+}
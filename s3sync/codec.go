@@ -0,0 +1,163 @@
+package s3sync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+
+	"github.com/restic/chunker"
+)
+
+//nonceSize is the size of the nonce that is appended to encrypted objects
+const nonceSize = 12
+
+//Codec determines how chunks are named and how they are stored. A nil codec names a chunk
+//by the SHA-256 of its content and stores it as is. A codec with a secret names chunks by a
+//keyed hash (HMAC-SHA256) so names don't reveal their content and stores them encrypted with
+//AES-GCM. The nonce is derived from the stored content, so identical chunks still end up as
+//identical objects and are only uploaded once. Chunks are compressed before they are
+//encrypted, any codec can decode objects regardless of the compression they use.
+type Codec struct {
+	comp     Compression
+	aead     cipher.AEAD
+	nameKey  []byte
+	nonceKey []byte
+	hmacs    sync.Pool
+}
+
+//NewCodec creates a codec that compresses chunks as given. If a secret is given the keys
+//for naming and encrypting chunks are derived from it, it is expected to be long and random
+func NewCodec(secret []byte, comp Compression) (c *Codec, err error) {
+	if _, ok := compressionNames[comp]; !ok {
+		return nil, fmt.Errorf("unsupported compression %s", comp)
+	}
+
+	c = &Codec{comp: comp}
+	if len(secret) == 0 {
+		return c, nil
+	}
+
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("secret is too short, expected at least 16 bytes")
+	}
+
+	c.nameKey = deriveKey(secret, "s3sync chunk name")
+	c.nonceKey = deriveKey(secret, "s3sync chunk nonce")
+	block, err := aes.NewCipher(deriveKey(secret, "s3sync chunk encryption"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup cipher: %v", err)
+	}
+
+	c.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup gcm: %v", err)
+	}
+
+	c.hmacs.New = func() interface{} { return hmac.New(sha256.New, c.nameKey) }
+	return c, nil
+}
+
+//deriveKey derives a 256 bit key for a single purpose from the secret
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+//Encrypted returns whether chunks are encrypted
+func (c *Codec) Encrypted() bool {
+	return c != nil && c.aead != nil
+}
+
+//Compression returns how chunks are compressed
+func (c *Codec) Compression() Compression {
+	if c == nil {
+		return NoCompression
+	}
+
+	return c.comp
+}
+
+//Key returns the key that names a chunk with the given content
+func (c *Codec) Key(chunk []byte) (k K) {
+	if !c.Encrypted() {
+		return sha256.Sum256(chunk)
+	}
+
+	mac := c.hmacs.Get().(hash.Hash)
+	defer c.hmacs.Put(mac)
+	mac.Reset()
+	mac.Write(chunk)
+	mac.Sum(k[:0])
+	return k
+}
+
+//Overhead returns how many bytes an object is larger than its chunk at most
+func (c *Codec) Overhead() int {
+	if !c.Encrypted() {
+		return frameSize
+	}
+
+	return frameSize + c.aead.Overhead() + nonceSize
+}
+
+//encodeSize returns how many bytes of buffers are held while encoding a chunk of n bytes,
+//for the object and, when encrypting, for the payload that is sealed
+func (c *Codec) encodeSize(n int) int {
+	if !c.Encrypted() {
+		return n + c.Overhead()
+	}
+
+	return n + c.Overhead() + n + frameSize
+}
+
+//Encode turns a chunk into the content of its object, which is appended to dst
+func (c *Codec) Encode(dst, chunk []byte) (obj []byte, err error) {
+	if !c.Encrypted() {
+		return frame(dst, chunk, c.Compression())
+	}
+
+	payload, err := frame(pool.get(len(chunk) + frameSize)[:0], chunk, c.comp)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pool.put(payload)
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(payload)
+	nonce := mac.Sum(nil)[:nonceSize]
+
+	obj = c.aead.Seal(dst, nonce, payload, nil)
+	return append(obj, nonce...), nil
+}
+
+//Decode turns the content of an object back into its chunk. Decryption happens in place
+//and chunks that were not compressed are not copied, so the returned chunk may share its
+//buffer with the object.
+func (c *Codec) Decode(obj []byte) (chunk []byte, err error) {
+	return c.decode(obj, chunker.MaxSize)
+}
+
+//decode is Decode for content that may be larger than a chunk, such as a manifest
+func (c *Codec) decode(obj []byte, max int) (chunk []byte, err error) {
+	payload := obj
+	if c.Encrypted() {
+		if len(obj) < nonceSize+c.aead.Overhead() {
+			return nil, errors.New("object is too small to be encrypted")
+		}
+
+		var nonce [nonceSize]byte
+		copy(nonce[:], obj[len(obj)-nonceSize:])
+		payload, err = c.aead.Open(obj[:0], nonce[:], obj[:len(obj)-nonceSize], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %v", err)
+		}
+	}
+
+	return unframe(payload, max)
+}
@@ -0,0 +1,262 @@
+package s3sync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//Compression identifies how the content of a chunk is compressed
+type Compression byte
+
+const (
+	//NoCompression stores chunks as is
+	NoCompression Compression = iota
+
+	//Gzip compresses chunks with gzip, for compatibility
+	Gzip
+
+	//Zstd compresses chunks with zstandard, which is both faster and smaller than gzip
+	Zstd
+)
+
+var compressionNames = map[Compression]string{
+	NoCompression: "none",
+	Gzip:          "gzip",
+	Zstd:          "zstd",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+//ParseCompression returns the compression with the given name
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+
+	return NoCompression, fmt.Errorf("unknown compression '%s', expected 'none', 'gzip' or 'zstd'", name)
+}
+
+//MarshalText encodes the compression by its name
+func (c Compression) MarshalText() ([]byte, error) {
+	if _, ok := compressionNames[c]; !ok {
+		return nil, fmt.Errorf("unsupported compression %s", c)
+	}
+
+	return []byte(c.String()), nil
+}
+
+//UnmarshalText decodes a compression from its name
+func (c *Compression) UnmarshalText(text []byte) (err error) {
+	*c, err = ParseCompression(string(text))
+	return err
+}
+
+//NewWriter returns a writer that compresses a whole stream into w, as a standalone gzip
+//or zstd file. It must be closed to flush the end of the stream, this doesn't close w.
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", c)
+	}
+}
+
+//nopWriteCloser has a Close that does nothing
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+//frameMagic starts a framed chunk, a frame is laid out as:
+//
+//  magic (4) | compression (1) | chunk size (4, big endian) | payload
+//
+//Chunks that are stored as is go without a frame, unless they start with the magic
+//themselves. This keeps such objects compatible with those written before compression
+//existed, while repositories with a mix of codecs can still be read.
+var frameMagic = []byte{0x00, 'S', '3', 'C'}
+
+const frameSize = 9
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+	gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+)
+
+//zstdCodec returns the shared zstd encoder and decoder, both are safe for concurrent use
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEnc, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+
+		zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+	})
+
+	return zstdEnc, zstdDec, zstdErr
+}
+
+//frame appends the chunk to dst, compressed if that makes it smaller
+func frame(dst, chunk []byte, comp Compression) (_ []byte, err error) {
+	start := len(dst)
+	if comp != NoCompression {
+		dst = appendFrameHeader(dst, comp, len(chunk))
+		dst, err = compress(dst, chunk, comp)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(dst)-start < len(chunk) {
+			return dst, nil
+		}
+
+		dst = dst[:start] //didn't shrink
+	}
+
+	if bytes.HasPrefix(chunk, frameMagic) {
+		dst = appendFrameHeader(dst, NoCompression, len(chunk))
+	}
+
+	return append(dst, chunk...), nil
+}
+
+func appendFrameHeader(dst []byte, comp Compression, size int) []byte {
+	var hdr [frameSize]byte
+	copy(hdr[:], frameMagic)
+	hdr[4] = byte(comp)
+	binary.BigEndian.PutUint32(hdr[5:], uint32(size))
+	return append(dst, hdr[:]...)
+}
+
+//compress appends the compressed chunk to dst
+func compress(dst, chunk []byte, comp Compression) ([]byte, error) {
+	switch comp {
+	case Zstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup zstd: %v", err)
+		}
+
+		return enc.EncodeAll(chunk, dst), nil
+	case Gzip:
+		aw := &appendw{b: dst}
+		gw := gzipPool.Get().(*gzip.Writer)
+		defer gzipPool.Put(gw)
+		gw.Reset(aw)
+		if _, err := gw.Write(chunk); err != nil {
+			return nil, fmt.Errorf("failed to gzip: %v", err)
+		}
+
+		if err := gw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip: %v", err)
+		}
+
+		return aw.b, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", comp)
+	}
+}
+
+//unframe returns the chunk held by a payload. A chunk that was stored as is shares its
+//buffer with the payload, a decompressed chunk is held in a buffer from the pool.
+func unframe(payload []byte, max int) (chunk []byte, err error) {
+	if !bytes.HasPrefix(payload, frameMagic) {
+		return payload, nil
+	}
+
+	if len(payload) < frameSize {
+		return nil, fmt.Errorf("truncated frame header")
+	}
+
+	comp := Compression(payload[4])
+	size := int(binary.BigEndian.Uint32(payload[5:]))
+	payload = payload[frameSize:]
+	if size > max {
+		return nil, fmt.Errorf("frame holds %d bytes, larger than any chunk", size)
+	}
+
+	switch comp {
+	case NoCompression:
+		chunk = payload
+	case Zstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup zstd: %v", err)
+		}
+
+		chunk, err = dec.DecodeAll(payload, pool.get(size)[:0])
+		if err != nil {
+			pool.put(chunk)
+			return nil, fmt.Errorf("failed to decompress zstd: %v", err)
+		}
+	case Gzip:
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip: %v", err)
+		}
+
+		chunk = pool.get(size)
+		var n int
+		n, err = io.ReadFull(gr, chunk)
+		if err == nil {
+			_, err = gr.Read(make([]byte, 1))
+			if err == nil {
+				err = fmt.Errorf("more data than the %d bytes in its header", size)
+			} else if err == io.EOF {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			pool.put(chunk)
+			return nil, fmt.Errorf("failed to decompress gzip: %v", err)
+		}
+
+		chunk = chunk[:n]
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", comp)
+	}
+
+	if len(chunk) != size {
+		if comp != NoCompression {
+			pool.put(chunk)
+		}
+
+		return nil, fmt.Errorf("frame holds %d bytes, but its header says %d", len(chunk), size)
+	}
+
+	return chunk, nil
+}
+
+//appendw appends everything that is written to a byte slice
+type appendw struct {
+	b []byte
+}
+
+func (aw *appendw) Write(p []byte) (int, error) {
+	aw.b = append(aw.b, p...)
+	return len(p), nil
+}
@@ -0,0 +1,193 @@
+package s3sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/restic/chunker"
+)
+
+//ConfigName is the name of the object that holds the repository config
+const ConfigName = "config"
+
+//FormatVersion is the version of the repository format this version reads and writes
+const FormatVersion = 1
+
+const (
+	hashSHA256     = "sha256"
+	hashHMACSHA256 = "hmac-sha256"
+)
+
+//configCheck is named by the codec when a repository is initialized, comparing its key
+//later on tells whether a secret is the one the repository was created with
+var configCheck = []byte("s3sync repository config check")
+
+//ErrNoConfig is returned when a repository has no config, it was then never initialized
+var ErrNoConfig = errors.New("repository is not initialized")
+
+//Config describes how a repository stores its data. It is written once when the repository
+//is initialized, every command reads it to chunk, name and encode data the same way.
+type Config struct {
+	Version     int         `json:"version"`
+	Created     time.Time   `json:"created"`
+	Polynomial  chunker.Pol `json:"polynomial"`
+	MinSize     uint        `json:"min_size"`
+	MaxSize     uint        `json:"max_size"`
+	Hash        string      `json:"hash"`
+	Encrypted   bool        `json:"encrypted"`
+	Compression Compression `json:"compression"`
+	Check       K           `json:"check"`
+}
+
+//NewConfig returns the config for a new repository whose chunks are named and encoded by
+//the given codec. Each repository gets its own random polynomial, so chunk boundaries can't
+//be predicted from content alone.
+func NewConfig(c *Codec) (cfg *Config, err error) {
+	cfg = &Config{
+		Version:     FormatVersion,
+		Created:     time.Now(),
+		MinSize:     chunker.MinSize,
+		MaxSize:     chunker.MaxSize,
+		Hash:        hashSHA256,
+		Encrypted:   c.Encrypted(),
+		Compression: c.Compression(),
+		Check:       c.Key(configCheck),
+	}
+
+	if cfg.Encrypted {
+		cfg.Hash = hashHMACSHA256
+	}
+
+	cfg.Polynomial, err = chunker.RandomPolynomial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate polynomial: %v", err)
+	}
+
+	return cfg, nil
+}
+
+//Validate checks whether the config can be used by this version
+func (cfg *Config) Validate() error {
+	if cfg.Version != FormatVersion {
+		return fmt.Errorf("repository has format version %d, this version of s3sync only supports version %d", cfg.Version, FormatVersion)
+	}
+
+	if cfg.Polynomial.Deg() != 53 || !cfg.Polynomial.Irreducible() {
+		return fmt.Errorf("polynomial %s is not an irreducible polynomial of degree 53", cfg.Polynomial)
+	}
+
+	if cfg.MinSize < 64*1024 || cfg.MinSize > cfg.MaxSize || cfg.MaxSize > chunker.MaxSize {
+		return fmt.Errorf("chunk sizes %d-%d are invalid, expected 64KiB <= min <= max <= %d", cfg.MinSize, cfg.MaxSize, chunker.MaxSize)
+	}
+
+	if _, ok := compressionNames[cfg.Compression]; !ok {
+		return fmt.Errorf("unsupported compression %s", cfg.Compression)
+	}
+
+	if (cfg.Encrypted && cfg.Hash != hashHMACSHA256) || (!cfg.Encrypted && cfg.Hash != hashSHA256) {
+		return fmt.Errorf("unsupported hash '%s'", cfg.Hash)
+	}
+
+	return nil
+}
+
+//Codec returns the codec the repository requires, it fails if the secret doesn't match
+//the one the repository was initialized with. An empty secret means no encryption.
+func (cfg *Config) Codec(secret []byte) (c *Codec, err error) {
+	if cfg.Encrypted && len(secret) == 0 {
+		return nil, fmt.Errorf("repository is encrypted but no secret was given")
+	} else if !cfg.Encrypted && len(secret) > 0 {
+		return nil, fmt.Errorf("repository is not encrypted but a secret was given")
+	}
+
+	c, err = NewCodec(secret, cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Key(configCheck) != cfg.Check {
+		return nil, fmt.Errorf("secret doesn't match the one the repository was initialized with")
+	}
+
+	return c, nil
+}
+
+//Chunker returns a chunker that splits the data from r as configured
+func (cfg *Config) Chunker(r io.Reader) *chunker.Chunker {
+	cr := chunker.New(r, cfg.Polynomial)
+	cr.MinSize = cfg.MinSize
+	cr.MaxSize = cfg.MaxSize
+	return cr
+}
+
+//PutConfig stores the config of a new repository, it fails if the repository already has one
+func PutConfig(ctx context.Context, s3 *S3, cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+
+	err = s3.PutObjectIf(ctx, ConfigName, data, "")
+	if err == ErrConditionalUnsupported {
+		var has bool
+		has, err = s3.HasObject(ctx, ConfigName) //racy, but the best we can do
+		if err != nil {
+			return fmt.Errorf("failed to check for existing config: %v", err)
+		} else if has {
+			err = ErrPreconditionFailed
+		} else {
+			err = s3.PutObject(ctx, ConfigName, data)
+		}
+	}
+
+	if err == ErrPreconditionFailed {
+		return fmt.Errorf("repository is already initialized")
+	} else if err != nil {
+		return fmt.Errorf("failed to put config: %v", err)
+	}
+
+	return nil
+}
+
+//GetConfig fetches and validates the config of the repository, ErrNoConfig is returned if
+//the repository has none
+func GetConfig(ctx context.Context, s3 *S3) (cfg *Config, err error) {
+	resp, err := s3.GetObject(ctx, ConfigName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config: %v", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoConfig
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for config: %v", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+
+	cfg = &Config{}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
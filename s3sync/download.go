@@ -1,89 +1,255 @@
 package s3sync
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"time"
+
+	"github.com/restic/chunker"
 )
 
-//Download pulls chunks from s3 and writes them
-func Download(kr KeyReader, cw io.Writer, concurrency int, s3 *S3) (err error) {
-	type result struct {
-		err   error
-		chunk []byte
+//CorruptError is returned when the content of a chunk doesn't match its key
+type CorruptError struct {
+	K   K     //key of the chunk
+	Got K     //key of the content that was received instead
+	Err error //set when the content couldn't be decoded at all
+}
+
+func (e *CorruptError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("chunk '%x' is corrupt: %v", e.K, e.Err)
 	}
 
+	return fmt.Sprintf("chunk '%x' is corrupt, its content hashes to '%x'", e.K, e.Got)
+}
+
+//DownloadOpts configures a Download
+type DownloadOpts struct {
+	Limits
+	Codec *Codec       //names and decodes chunks, nil expects them as is under their SHA-256
+	Cache *Cache       //chunks are read from and stored in this cache, if not nil
+	Local *LocalChunks //chunks are taken from local data first, if not nil
+}
+
+//Download pulls chunks from s3 and writes them. Every chunk is checked against its key,
+//a corrupt chunk is fetched again and a *CorruptError is returned if it stays corrupt.
+//When an error occurs, or the context is cancelled, in-flight requests are cancelled
+//and no goroutine is left blocked
+func Download(ctx context.Context, kr KeyReader, cw io.Writer, opts DownloadOpts, s3 *S3) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	type item struct {
 		k     K
-		resCh chan *result
+		chunk []byte
 		err   error
+		done  chan struct{}
 	}
 
+	//the size of a chunk is only known once its response arrives, so the largest
+	//possible size is acquired up front and the surplus released when it's known. That
+	//includes a buffer to decompress into, an object may be compressed even if the
+	//codec doesn't compress what it encodes
+	maxObjectSize := chunker.MaxSize + opts.Codec.Overhead()
+	reserved := maxObjectSize + chunker.MaxSize
+	lim := opts.Limits.withDefaults(int64(reserved))
+	bud := newBudget(lim.MaxInFlight)
 	work := func(it *item) {
-		var resp *http.Response
-		resp, err = s3.Get(it.k[:])
-		if err != nil {
-			it.resCh <- &result{fmt.Errorf("failed to get key '%x': %v", it.k, err), nil}
-			return
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			it.resCh <- &result{fmt.Errorf("unexpected status for '%x': %v", it.k, resp.Status), nil}
-			return
+		defer close(it.done)
+		if chunk, ok := opts.Local.Get(it.k); ok {
+			it.chunk = chunk
+		} else {
+			it.chunk, it.err = fetch(ctx, s3, opts.Codec, opts.Cache, it.k, maxObjectSize)
 		}
 
-		var chunk []byte
-		chunk, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			it.resCh <- &result{fmt.Errorf("failed to get read response body for '%x': %v", it.k, err), nil}
-			return
-		}
+		bud.release(int64(reserved - len(it.chunk)))
+	}
 
-		it.resCh <- &result{nil, chunk}
+	//fixed pool of workers
+	workCh := make(chan *item)
+	for i := 0; i < lim.Workers; i++ {
+		go func() {
+			for it := range workCh {
+				work(it)
+			}
+		}()
 	}
 
-	//fan out
-	itemCh := make(chan *item, concurrency)
+	//fan out, items are queued in stream order for the fan-in and handed to a worker
+	itemCh := make(chan *item, lim.Workers)
 	go func() {
 		defer close(itemCh)
+		defer close(workCh)
 		for {
-			var k K
-			k, err = kr.Read()
+			k, err := kr.Read()
 			if err != nil {
 				if err != io.EOF {
-					itemCh <- &item{err: err}
+					select {
+					case itemCh <- &item{err: fmt.Errorf("failed to iterate: %v", err), done: closed}:
+					case <-ctx.Done():
+					}
 				}
 
-				break
+				return
+			}
+
+			if bud.acquire(ctx, int64(reserved)) != nil {
+				return
 			}
 
-			it := &item{
-				k:     k,
-				resCh: make(chan *result),
+			it := &item{k: k, done: make(chan struct{})}
+			select {
+			case itemCh <- it: //send to fan-in thread for syncing results
+			case <-ctx.Done():
+				return
 			}
 
-			go work(it)  //create work
-			itemCh <- it //send to fan-in thread for syncing results
+			select {
+			case workCh <- it: //create work
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	//fan-in
 	for it := range itemCh {
-		if it.err != nil {
-			return fmt.Errorf("failed to iterate: %v", it.err)
+		select {
+		case <-it.done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
-		res := <-it.resCh
-		if res.err != nil {
-			return res.err
+		if it.err != nil {
+			return it.err
 		}
 
-		_, err = cw.Write(res.chunk)
+		_, err = cw.Write(it.chunk)
+		bud.release(int64(len(it.chunk)))
+		pool.put(it.chunk)
 		if err != nil {
 			return fmt.Errorf("failed to write key: %v", err)
 		}
 	}
 
-	return nil
+	return ctx.Err()
+}
+
+//fetch gets the chunk for key k, from the cache if it has it, decodes it and verifies its
+//content. Corrupt chunks are retried as configured for the s3 client since they are usually
+//damaged in transit
+func fetch(ctx context.Context, s3 *S3, c *Codec, cache *Cache, k K, max int) (chunk []byte, err error) {
+	if cache != nil {
+		if obj, ok := cache.Get(k, max); ok {
+			chunk, err = verify(c, k, obj)
+			if err == nil {
+				return chunk, nil
+			}
+
+			cache.Remove(k) //damaged on disk, fetch it anew
+		}
+	}
+
+	for i := 0; ; i++ {
+		var obj []byte
+		obj, err = get(ctx, s3, k, max)
+		if err != nil {
+			return nil, err
+		}
+
+		if cache != nil {
+			cache.Put(k, obj) //before decoding, which happens in place. Failing to cache is not fatal
+		}
+
+		chunk, err = verify(c, k, obj)
+		if err == nil {
+			return chunk, nil
+		}
+
+		if cache != nil {
+			cache.Remove(k)
+		}
+
+		if i+1 >= s3.Retry.MaxAttempts {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(s3.Retry.backoff(i)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//verify decodes an object and checks its content against key k, a *CorruptError is
+//returned if it doesn't match. The object's buffer is handed back to the pool unless it
+//is returned as the chunk
+func verify(c *Codec, k K, obj []byte) (chunk []byte, err error) {
+	cerr := &CorruptError{K: k}
+	chunk, cerr.Err = c.Decode(obj)
+	if cerr.Err != nil {
+		pool.put(obj)
+		return nil, cerr
+	}
+
+	if !sameBuffer(chunk, obj) {
+		pool.put(obj) //decompressed into a buffer of its own
+	}
+
+	cerr.Got = c.Key(chunk)
+	if cerr.Got != k {
+		pool.put(chunk)
+		return nil, cerr
+	}
+
+	return chunk, nil
+}
+
+//get fetches the object for key k into a pooled buffer
+func get(ctx context.Context, s3 *S3, k K, maxObjectSize int) (chunk []byte, err error) {
+	resp, err := s3.Get(ctx, k[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key '%x': %v", k, err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for '%x': %v", k, resp.Status)
+	}
+
+	if resp.ContentLength > int64(maxObjectSize) {
+		return nil, fmt.Errorf("object for '%x' is %d bytes, larger than any chunk", k, resp.ContentLength)
+	}
+
+	if resp.ContentLength >= 0 {
+		chunk = pool.get(int(resp.ContentLength))
+		_, err = io.ReadFull(resp.Body, chunk)
+	} else {
+		chunk, err = readAtMost(resp.Body, maxObjectSize)
+	}
+
+	if err != nil {
+		pool.put(chunk)
+		return nil, fmt.Errorf("failed to get read response body for '%x': %v", k, err)
+	}
+
+	return chunk, nil
+}
+
+//readAtMost reads r until EOF into a pooled buffer, it fails if r holds more than max bytes
+func readAtMost(r io.Reader, max int) (b []byte, err error) {
+	b = pool.get(max + 1)
+	n, err := io.ReadFull(r, b)
+	if err == nil {
+		pool.put(b)
+		return nil, fmt.Errorf("body is larger than %d bytes", max)
+	} else if err != io.ErrUnexpectedEOF && err != io.EOF {
+		pool.put(b)
+		return nil, err
+	}
+
+	return b[:n], nil
 }
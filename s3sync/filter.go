@@ -0,0 +1,77 @@
+package s3sync
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//FilterTar copies a tar stream as written by Tar and leaves out entries the way Tar would,
+//by the exclude and include patterns and the max file size of the options. Other options
+//don't apply and '.s3syncignore' files in the archive are not read, they were applied
+//when it was written. Hardlinks to a file that is left out are left out as well since
+//their content went with that file.
+func FilterTar(r io.Reader, w io.Writer, opts TarOpts) (err error) {
+	ig, err := newIgnorer(opts.Excludes, opts.Includes)
+	if err != nil {
+		return err
+	}
+
+	skip := func(rel, why string) {
+		if opts.Skipped != nil {
+			opts.Skipped(rel, why)
+		}
+	}
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	written := map[string]bool{}
+	skipDir := "" //excluded directory, its content follows it in the stream
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read tar: %v", err)
+		}
+
+		rel := strings.TrimSuffix(hdr.Name, "/")
+		isDir := hdr.Typeflag == tar.TypeDir
+		switch {
+		case skipDir != "" && strings.HasPrefix(rel, skipDir+"/"):
+			continue //reported with its directory
+		case ig.excluded(rel, isDir):
+			skip(rel, "excluded")
+			if isDir {
+				skipDir = rel
+			}
+
+			continue
+		case opts.MaxFileSize > 0 && hdr.Typeflag == tar.TypeReg && hdr.Size > opts.MaxFileSize:
+			skip(rel, "too large")
+			continue
+		case hdr.Typeflag == tar.TypeLink && !written[hdr.Linkname]:
+			skip(rel, "hardlink to a file that is left out")
+			continue
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("failed to write tar header for '%s': %v", rel, err)
+		}
+
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return fmt.Errorf("failed to copy tar file for '%s': %v", rel, err)
+		}
+
+		written[hdr.Name] = true
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("failed to write remaining data: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package s3sync
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+//GCOpts configures a garbage collection
+type GCOpts struct {
+	Grace  time.Duration //objects younger than this are never removed, it protects pushes that are in progress
+	Keep   KeepFunc      //decides which snapshots are kept, nil keeps all of them
+	DryRun bool          //only determine what would be removed
+}
+
+//KeepFunc returns which of the snapshots are to be kept
+type KeepFunc func(snapshots map[K]*Manifest) (keep map[K]bool)
+
+//GCStats describes what a garbage collection removed, or would remove on a dry run
+type GCStats struct {
+	Snapshots      int   //nr of snapshots in the repository
+	Forgotten      int   //nr of snapshots that are not kept
+	Chunks         int   //nr of chunks in the repository
+	Referenced     int   //nr of chunks that are referenced by kept snapshots
+	Young          int   //nr of unreferenced chunks that are kept because of the grace period
+	Removed        int   //nr of chunks that are removed
+	RemovedBytes   int64 //nr of bytes of the removed chunks
+	ForgottenBytes int64 //nr of bytes of the removed manifests
+}
+
+//GC removes snapshots that are not kept and the chunks that are no longer referenced by
+//any snapshot (mark and sweep). Snapshots that are tagged or younger than the grace period
+//are always kept, as are chunks younger than the grace period, since these may belong to
+//a push that is still in progress. Unless it's a dry run, an exclusive lock is held on the
+//repository so no push can reuse a chunk that is being removed. Before anything is removed
+//a new epoch is written, so local indexes that still hold removed keys are discarded.
+func GC(ctx context.Context, s3 *S3, c *Codec, opts GCOpts) (st *GCStats, err error) {
+	if !opts.DryRun {
+		var lock *Lock
+		lock, err = LockRepository(ctx, s3, true)
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if uerr := lock.Unlock(); err == nil {
+				err = uerr
+			}
+		}()
+	}
+
+	st = &GCStats{}
+	cutoff := time.Now().Add(-opts.Grace)
+
+	refs, err := ListTags(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+
+	tagged := map[K]bool{}
+	for _, ref := range refs {
+		tagged[ref.Snapshot] = true
+	}
+
+	//every manifest must be readable, as its chunks would otherwise be removed
+	snapshots := map[K]*Manifest{}
+	objs := map[K]Object{}
+	err = s3.List(ctx, SnapshotPrefix, func(obj Object) error {
+		id, err := ParseK(obj.Name[len(SnapshotPrefix):])
+		if err != nil {
+			return nil //not a manifest
+		}
+
+		snapshots[id], err = GetManifest(ctx, s3, c, id)
+		objs[id] = obj
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots: %v", err)
+	}
+
+	var keep map[K]bool
+	if opts.Keep != nil {
+		keep = opts.Keep(snapshots)
+	}
+
+	//mark
+	marked := map[K]bool{}
+	forgotten := []string{}
+	for id, m := range snapshots {
+		st.Snapshots++
+		if obj := objs[id]; opts.Keep != nil && !keep[id] && !tagged[id] && obj.LastModified.Before(cutoff) {
+			st.Forgotten++
+			st.ForgottenBytes += obj.Size
+			forgotten = append(forgotten, obj.Name)
+			continue
+		}
+
+		for _, k := range m.Keys {
+			marked[k] = true
+		}
+	}
+
+	//sweep, only objects named by a key are chunks
+	sweep := []string{}
+	err = s3.List(ctx, "", func(obj Object) error {
+		k, err := ParseK(obj.Name)
+		if err != nil {
+			return nil
+		}
+
+		st.Chunks++
+		if marked[k] {
+			st.Referenced++
+		} else if !obj.LastModified.Before(cutoff) {
+			st.Young++
+		} else {
+			st.Removed++
+			st.RemovedBytes += obj.Size
+			sweep = append(sweep, obj.Name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %v", err)
+	}
+
+	if opts.DryRun || (len(sweep) == 0 && len(forgotten) == 0) {
+		return st, nil
+	}
+
+	err = putEpoch(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s3.DeleteObjects(ctx, forgotten) //manifests first, so no snapshot refers to removed chunks
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove snapshots: %v", err)
+	}
+
+	err = s3.DeleteObjects(ctx, sweep)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove chunks: %v", err)
+	}
+
+	return st, nil
+}
+
+//putEpoch starts a new epoch of the repository
+func putEpoch(ctx context.Context, s3 *S3) error {
+	var epoch [16]byte
+	_, err := rand.Read(epoch[:])
+	if err != nil {
+		return fmt.Errorf("failed to generate epoch: %v", err)
+	}
+
+	err = s3.PutObject(ctx, EpochName, []byte(fmt.Sprintf("%x", epoch)))
+	if err != nil {
+		return fmt.Errorf("failed to put epoch: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package s3sync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//IgnoreFileName is the name of files with exclude patterns for their directory and below
+const IgnoreFileName = ".s3syncignore"
+
+//ignoreRule is a single gitignore-style pattern
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool //the pattern started with '!', matching paths are included again
+	dirOnly bool //the pattern ended with '/', it only matches directories
+}
+
+//ignoreRules are the patterns of one source, they apply to paths below base
+type ignoreRules struct {
+	base  string //slash separated directory the patterns are relative to, empty for the root
+	rules []ignoreRule
+}
+
+//parseIgnore parses gitignore-style patterns that are relative to base. Blank lines and
+//lines starting with '#' are skipped, a leading '!' negates a pattern, a trailing '/'
+//only matches directories. Patterns with a slash other than a trailing one are anchored
+//to base, others match a name at any depth. A '**' matches any nr of directories.
+func parseIgnore(base string, patterns []string) (set *ignoreRules, err error) {
+	set = &ignoreRules{base: base}
+	for _, p := range patterns {
+		if !strings.HasSuffix(p, `\ `) {
+			p = strings.TrimRight(p, " \t\r")
+		}
+
+		if p == "" || p[0] == '#' {
+			continue
+		}
+
+		r := ignoreRule{}
+		if p[0] == '!' {
+			r.negate = true
+			p = p[1:]
+		} else if p[0] == '\\' && len(p) > 1 && (p[1] == '!' || p[1] == '#') {
+			p = p[1:]
+		}
+
+		if strings.HasSuffix(p, "/") {
+			r.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+
+		anchored := strings.Contains(p, "/")
+		p = strings.TrimPrefix(p, "/")
+		if p == "" {
+			continue
+		}
+
+		expr := globRegexp(p)
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+
+		r.re, err = regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", p, err)
+		}
+
+		set.rules = append(set.rules, r)
+	}
+
+	return set, nil
+}
+
+//globRegexp translates a glob with '*', '?', '[...]' and '**' into a regular expression
+func globRegexp(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/") && (i == 0 || p[i-1] == '/'):
+			b.WriteString("(.*/)?")
+			i += 2
+		case p[i:] == "**" && i > 0 && p[i-1] == '/':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+//match reports whether any rule matches the slash separated path rel and, if so, whether
+//the last matching rule excludes it
+func (set *ignoreRules) match(rel string, isDir bool) (matched, excluded bool) {
+	if set.base != "" {
+		if !strings.HasPrefix(rel, set.base+"/") {
+			return false, false
+		}
+
+		rel = rel[len(set.base)+1:]
+	}
+
+	for _, r := range set.rules {
+		if (r.dirOnly && !isDir) || !r.re.MatchString(rel) {
+			continue
+		}
+
+		matched, excluded = true, !r.negate
+	}
+
+	return matched, excluded
+}
+
+//ignorer decides which paths are left out of an archive. Later rules take precedence
+//over earlier ones: excludes from options come first, then ignore files from the root
+//down, and includes from options have the final say. As with gitignore, an excluded
+//directory is not walked, so nothing below it can be included again.
+type ignorer struct {
+	sets     []*ignoreRules
+	includes *ignoreRules
+}
+
+//newIgnorer creates an ignorer for exclude and include patterns relative to the root
+func newIgnorer(excludes, includes []string) (ig *ignorer, err error) {
+	ig = &ignorer{}
+	set, err := parseIgnore("", excludes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse excludes: %v", err)
+	}
+
+	ig.sets = append(ig.sets, set)
+	negated := make([]string, 0, len(includes))
+	for _, p := range includes {
+		negated = append(negated, "!"+strings.TrimPrefix(p, "!"))
+	}
+
+	ig.includes, err = parseIgnore("", negated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse includes: %v", err)
+	}
+
+	return ig, nil
+}
+
+//load reads the ignore file in directory dir, if it has one. Rel is the slash separated
+//path of dir relative to the root. It must be called for parents before their children.
+func (ig *ignorer) load(dir, rel string) error {
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open ignore file: %v", err)
+	}
+
+	defer f.Close()
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+
+	if err = s.Err(); err != nil {
+		return fmt.Errorf("failed to read ignore file: %v", err)
+	}
+
+	if rel == "." {
+		rel = ""
+	}
+
+	set, err := parseIgnore(rel, lines)
+	if err != nil {
+		return fmt.Errorf("failed to parse ignore file '%s': %v", path.Join(rel, IgnoreFileName), err)
+	}
+
+	ig.sets = append(ig.sets, set)
+	return nil
+}
+
+//excluded returns whether the slash separated path rel is to be left out
+func (ig *ignorer) excluded(rel string, isDir bool) (excluded bool) {
+	for _, set := range ig.sets {
+		if m, ex := set.match(rel, isDir); m {
+			excluded = ex
+		}
+	}
+
+	if m, ex := ig.includes.match(rel, isDir); m {
+		excluded = ex
+	}
+
+	return excluded
+}
@@ -0,0 +1,196 @@
+package s3sync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dchest/safefile"
+)
+
+//EpochName is the name of the object that changes whenever chunks are deleted from the
+//repository, local indexes of keys that were built in another epoch are discarded
+const EpochName = "epoch"
+
+//indexHeader starts every index file, it is followed by the tag of the index
+const indexHeader = "s3sync index v1 "
+
+//Index is a persistent local set of keys that are known to be stored in a repository, it
+//allows an upload to skip asking whether a chunk exists. Keys are appended to the index
+//file, which may be shared by several processes. An index carries a tag that identifies the
+//state of the repository it was built for, an index with another tag is started anew.
+type Index struct {
+	path string
+	tag  string
+
+	mu      sync.RWMutex
+	keys    map[K]struct{}
+	pending []K
+}
+
+//GetEpoch returns the current epoch of the repository, which is empty if chunks were never
+//deleted
+func GetEpoch(ctx context.Context, s3 *S3) (epoch string, err error) {
+	resp, err := s3.GetObject(ctx, EpochName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get epoch: %v", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status for epoch: %v", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read epoch: %v", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+//OpenIndex loads the index at path, it is reset if it doesn't exist or carries another tag
+func OpenIndex(path, tag string) (ix *Index, err error) {
+	ix = &Index{path: path, tag: tag, keys: map[K]struct{}{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ix, ix.Reset()
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read index: %v", err)
+	}
+
+	nl := bytes.IndexByte(data, '\n')
+	if nl < 0 || string(data[:nl]) != indexHeader+tag {
+		return ix, ix.Reset()
+	}
+
+	data = data[nl+1:]
+	for len(data) >= len(K{}) { //a partially written key at the end is ignored
+		var k K
+		copy(k[:], data)
+		ix.keys[k] = struct{}{}
+		data = data[len(k):]
+	}
+
+	return ix, nil
+}
+
+//Has returns whether key k is known to be stored, it is safe to call on a nil index
+func (ix *Index) Has(k K) bool {
+	if ix == nil {
+		return false
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	_, ok := ix.keys[k]
+	return ok
+}
+
+//Add records that key k is stored, it is written to disk on the next Flush. It is safe
+//to call on a nil index
+func (ix *Index) Add(k K) {
+	if ix == nil {
+		return
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if _, ok := ix.keys[k]; !ok {
+		ix.keys[k] = struct{}{}
+		ix.pending = append(ix.pending, k)
+	}
+}
+
+//Len returns the nr of known keys
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.keys)
+}
+
+//Flush appends the keys that were added since the last flush to the index file. If the
+//file was meanwhile reset with another tag, e.g because another process saw a new epoch,
+//the keys are dropped as they may no longer be stored.
+func (ix *Index) Flush() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if len(ix.pending) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(ix.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open index: %v", err)
+	}
+
+	//the file is replaced as a whole when it is reset, so the header read here belongs to
+	//the same file the keys are appended to
+	defer f.Close()
+	header := []byte(indexHeader + ix.tag + "\n")
+	current := make([]byte, len(header))
+	if _, err = f.ReadAt(current, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read index: %v", err)
+	}
+
+	if !bytes.Equal(current, header) {
+		ix.pending = nil
+		return nil
+	}
+
+	w := bufio.NewWriterSize(f, 32*1024) //a multiple of the key size, so keys are never split over writes
+	for _, k := range ix.pending {
+		w.Write(k[:])
+	}
+
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+
+	ix.pending = nil
+	return f.Close()
+}
+
+//Reset forgets all keys
+func (ix *Index) Reset() error {
+	return ix.Retain(func(K) bool { return false })
+}
+
+//Retain keeps the keys for which fn returns true and rewrites the index file with them
+func (ix *Index) Retain(fn func(k K) bool) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	buf := bytes.NewBufferString(indexHeader + ix.tag + "\n")
+	for k := range ix.keys {
+		if !fn(k) {
+			delete(ix.keys, k)
+			continue
+		}
+
+		buf.Write(k[:])
+	}
+
+	ix.pending = nil
+	err := os.MkdirAll(filepath.Dir(ix.path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create index directory: %v", err)
+	}
+
+	err = safefile.WriteFile(ix.path, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package s3sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/restic/chunker"
+)
+
+//LocalChunks holds chunks of local data, so that a download can take them from disk
+//instead of fetching them. Chunks are copied to a spool file, which keeps them available
+//while the directory they came from is being overwritten.
+type LocalChunks struct {
+	f     *os.File
+	spans map[K]span
+}
+
+type span struct {
+	off int64
+	n   int
+}
+
+//IndexLocal tars and chunks a directory the same way a push would. Chunks whose key is
+//wanted are kept, chunks of unchanged data then match the keys of the snapshot that is
+//about to be downloaded. The returned chunks must be closed to remove the spool file.
+//The spool file is created in spoolDir, or next to dir if it is empty, as it may grow to
+//the size of the directory and the default temp dir is often a small in-memory file system
+func IndexLocal(ctx context.Context, dir, spoolDir string, cfg *Config, c *Codec, want map[K]bool) (lc *LocalChunks, err error) {
+	if spoolDir == "" {
+		spoolDir = filepath.Dir(filepath.Clean(dir))
+	}
+
+	f, err := ioutil.TempFile(spoolDir, ".s3sync-spool-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %v", err)
+	}
+
+	lc = &LocalChunks{f: f, spans: map[K]span{}}
+	defer func() {
+		if err != nil {
+			lc.Close()
+		}
+	}()
+
+	tarErrCh := make(chan error, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		err := Tar(ctx, dir, pw, TarOpts{})
+		pw.CloseWithError(err) //signals the end of the stream, or why it ended early
+		tarErrCh <- err
+	}()
+
+	defer pr.Close() //stops the tar writer if chunking failed
+	cr := cfg.Chunker(pr)
+	buf := make([]byte, chunker.MaxSize)
+	off := int64(0)
+	for {
+		chunk, err := cr.Next(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to chunk '%s': %v", dir, err)
+		}
+
+		k := c.Key(chunk.Data)
+		if _, ok := lc.spans[k]; ok || !want[k] {
+			continue
+		}
+
+		_, err = f.WriteAt(chunk.Data, off)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to spool file: %v", err)
+		}
+
+		lc.spans[k] = span{off, len(chunk.Data)}
+		off += int64(len(chunk.Data))
+	}
+
+	if err = <-tarErrCh; err != nil {
+		return nil, err
+	}
+
+	return lc, nil
+}
+
+//Len returns the nr of distinct chunks that are available locally
+func (lc *LocalChunks) Len() int {
+	return len(lc.spans)
+}
+
+//Get returns the chunk for key k in a pooled buffer, ok is false if it isn't available
+//locally. It is safe for concurrent use.
+func (lc *LocalChunks) Get(k K) (chunk []byte, ok bool) {
+	if lc == nil {
+		return nil, false
+	}
+
+	sp, ok := lc.spans[k]
+	if !ok {
+		return nil, false
+	}
+
+	chunk = pool.get(sp.n)
+	_, err := lc.f.ReadAt(chunk, sp.off)
+	if err != nil {
+		pool.put(chunk)
+		return nil, false
+	}
+
+	return chunk, true
+}
+
+//Close removes the spool file
+func (lc *LocalChunks) Close() error {
+	lc.f.Close()
+	return os.Remove(lc.f.Name())
+}
@@ -0,0 +1,127 @@
+package s3sync
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//LockPrefix is prepended to the name of lock objects, it keeps them apart from chunks
+const LockPrefix = "locks/"
+
+const (
+	//LockRefresh is how often a held lock is written again, to show it is still held
+	LockRefresh = 5 * time.Minute
+
+	//LockStale is how long a lock is honoured after it was last written, a process that
+	//didn't exit cleanly leaves its lock behind
+	LockStale = 30 * time.Minute
+)
+
+//Lock is held on the repository by pushes (shared) and garbage collections (exclusive),
+//since a push may reuse an unreferenced chunk that a garbage collection is removing
+type Lock struct {
+	name   string
+	s3     *S3
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+//LockRepository takes a lock on the repository. An exclusive lock can't be taken while
+//any other lock is held, a shared lock can't be taken while an exclusive lock is held.
+//The lock is written before the others are listed, so of two processes that race for
+//conflicting locks at least one sees the other. The lock is written again periodically
+//until it is released.
+func LockRepository(ctx context.Context, s3 *S3, exclusive bool) (l *Lock, err error) {
+	var id [16]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate lock id: %v", err)
+	}
+
+	kind := "shared"
+	if exclusive {
+		kind = "exclusive"
+	}
+
+	l = &Lock{
+		name:   fmt.Sprintf("%s%s-%x", LockPrefix, kind, id),
+		s3:     s3,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+
+	err = s3.PutObject(ctx, l.name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put lock: %v", err)
+	}
+
+	var held *Object
+	err = s3.List(ctx, LockPrefix, func(obj Object) error {
+		if obj.Name == l.name || time.Since(obj.LastModified) > LockStale {
+			return nil
+		}
+
+		if exclusive || strings.HasPrefix(obj.Name, LockPrefix+"exclusive-") {
+			held = &obj
+		}
+
+		return nil
+	})
+
+	if err == nil && held != nil {
+		err = fmt.Errorf("repository is locked by '%s', written %s ago, try again later. A lock that isn't written for %s is ignored",
+			held.Name, time.Since(held.LastModified).Truncate(time.Second), LockStale)
+	} else if err != nil {
+		err = fmt.Errorf("failed to list locks: %v", err)
+	}
+
+	if err != nil {
+		l.remove()
+		return nil, err
+	}
+
+	go l.refresh()
+	return l, nil
+}
+
+//Unlock releases the lock. It is removed even if the context it was taken with is
+//canceled, such as on an interrupt, else it would block others until it is stale
+func (l *Lock) Unlock() error {
+	close(l.stopCh)
+	<-l.doneCh
+	return l.remove()
+}
+
+//refresh writes the lock again until it is released, a failed write is retried on the
+//next refresh
+func (l *Lock) refresh() {
+	defer close(l.doneCh)
+	ticker := time.NewTicker(LockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), LockRefresh)
+			l.s3.PutObject(ctx, l.name, nil)
+			cancel()
+		}
+	}
+}
+
+//remove deletes the lock object
+func (l *Lock) remove() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := l.s3.DeleteObject(ctx, l.name)
+	if err != nil {
+		return fmt.Errorf("failed to remove lock '%s': %v", l.name, err)
+	}
+
+	return nil
+}
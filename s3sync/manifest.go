@@ -0,0 +1,149 @@
+package s3sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//SnapshotPrefix is prepended to the name of manifest objects, it keeps them apart from chunks
+const SnapshotPrefix = "snapshots/"
+
+//maxManifestSize bounds the size of a decoded manifest
+const maxManifestSize = 1 << 30
+
+const (
+	//KindDirectory is the kind of snapshots of a directory, their chunks form a tar stream
+	KindDirectory = ""
+
+	//KindStream is the kind of snapshots of a raw stream, such as a dump piped into a push
+	KindStream = "stream"
+)
+
+//Manifest describes a snapshot: the ordered keys of all chunks that together form
+//the tar stream of a directory, or a raw stream, and where that data came from
+type Manifest struct {
+	Created time.Time `json:"created"`
+	Host    string    `json:"host"`
+	Dir     string    `json:"dir"`
+	Kind    string    `json:"kind,omitempty"`
+	Size    int64     `json:"size"`
+	Keys    []K       `json:"keys"`
+}
+
+//Write appends a key, this allows the manifest to be filled by Upload
+func (m *Manifest) Write(k K) error {
+	m.Keys = append(m.Keys, k)
+	return nil
+}
+
+//Reader returns a key reader that iterates over the manifest keys in order
+func (m *Manifest) Reader() KeyReader {
+	return &manifestkr{keys: m.Keys}
+}
+
+type manifestkr struct {
+	keys []K
+	pos  int
+}
+
+func (kr *manifestkr) Read() (k K, err error) {
+	if kr.pos == len(kr.keys) {
+		return ZeroKey, io.EOF
+	}
+
+	k = kr.keys[kr.pos]
+	kr.pos++
+	return k, nil
+}
+
+//SnapshotName returns the object name of the manifest with the given id
+func SnapshotName(id K) string {
+	return fmt.Sprintf("%s%x", SnapshotPrefix, id)
+}
+
+//PutManifest stores the manifest under the key of its encoding, this key is returned
+//as the id of the snapshot. The codec names and encodes it just like a chunk
+func PutManifest(ctx context.Context, s3 *S3, c *Codec, m *Manifest) (id K, err error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return ZeroKey, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+
+	id = c.Key(data)
+	obj, err := c.Encode(nil, data)
+	if err != nil {
+		return ZeroKey, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+
+	err = s3.PutObject(ctx, SnapshotName(id), obj)
+	if err != nil {
+		return ZeroKey, fmt.Errorf("failed to put manifest: %v", err)
+	}
+
+	return id, nil
+}
+
+//GetManifest fetches the manifest of snapshot 'id' and checks it against its id
+func GetManifest(ctx context.Context, s3 *S3, c *Codec, id K) (m *Manifest, err error) {
+	resp, err := s3.GetObject(ctx, SnapshotName(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %v", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("snapshot '%x' does not exist", id)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for manifest '%x': %v", id, resp.Status)
+	}
+
+	max := int64(maxManifestSize + c.Overhead())
+	obj, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest '%x': %v", id, err)
+	} else if int64(len(obj)) > max {
+		return nil, fmt.Errorf("manifest '%x' is larger than %d bytes", id, max)
+	}
+
+	data, err := c.decode(obj, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest '%x', is the secret correct? %v", id, err)
+	}
+
+	if c.Key(data) != id {
+		return nil, fmt.Errorf("manifest '%x' doesn't match its content, is the secret correct?", id)
+	}
+
+	m = &Manifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest '%x': %v", id, err)
+	}
+
+	return m, nil
+}
+
+//ListSnapshots returns the ids of all snapshots stored in the bucket
+func ListSnapshots(ctx context.Context, s3 *S3) (ids []K, err error) {
+	err = s3.List(ctx, SnapshotPrefix, func(obj Object) error {
+		id, err := ParseK(strings.TrimPrefix(obj.Name, SnapshotPrefix))
+		if err != nil {
+			return nil //not a manifest
+		}
+
+		ids = append(ids, id)
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	return ids, nil
+}
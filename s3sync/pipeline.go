@@ -0,0 +1,153 @@
+package s3sync
+
+import (
+	"context"
+	"sync"
+
+	"github.com/restic/chunker"
+)
+
+//Limits bound the resources that Upload and Download use. Chunks are transferred by a
+//fixed number of workers and no more than MaxInFlight bytes of chunks, and the buffers
+//they are encoded or decoded in, are held in memory. The budget is raised to what the
+//largest possible chunk needs if it is configured lower.
+type Limits struct {
+	Workers     int   //nr of chunks that are transferred concurrently
+	MaxInFlight int64 //nr of buffer bytes that may be held in memory at once
+}
+
+//DefaultLimits are used for limits that are not configured
+var DefaultLimits = Limits{
+	Workers:     16,
+	MaxInFlight: 64 * 1024 * 1024,
+}
+
+//withDefaults fills in unset limits and makes sure that the buffers of the largest
+//possible chunk fit
+func (lim Limits) withDefaults(max int64) Limits {
+	if lim.Workers < 1 {
+		lim.Workers = DefaultLimits.Workers
+	}
+
+	if lim.MaxInFlight < 1 {
+		lim.MaxInFlight = DefaultLimits.MaxInFlight
+	}
+
+	if lim.MaxInFlight < max {
+		lim.MaxInFlight = max
+	}
+
+	return lim
+}
+
+//budget is a counting semaphore for bytes. Acquiring is only done in stream order by a
+//single goroutine, which keeps it simple and guarantees that earlier chunks are never
+//starved by later ones. Releasing can be done from any goroutine.
+type budget struct {
+	mu    sync.Mutex
+	avail int64
+	sig   chan struct{}
+}
+
+func newBudget(n int64) *budget {
+	return &budget{avail: n, sig: make(chan struct{}, 1)}
+}
+
+//acquire blocks until n bytes are available or the context is done
+func (b *budget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.avail >= n {
+			b.avail -= n
+			b.mu.Unlock()
+			return nil
+		}
+
+		b.mu.Unlock()
+		select {
+		case <-b.sig:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//release returns n bytes to the budget
+func (b *budget) release(n int64) {
+	b.mu.Lock()
+	b.avail += n
+	b.mu.Unlock()
+	select {
+	case b.sig <- struct{}{}:
+	default: //a wakeup is already pending
+	}
+}
+
+//bufPool recycles chunk buffers. Buffers are pooled per power-of-two size class, so
+//memory in use stays within twice the in-flight budget while allocation stays flat.
+type bufPool struct {
+	classes []sync.Pool
+}
+
+const minBufClass = 16 //64KiB
+
+var pool = newBufPool(2 * chunker.MaxSize) //room for objects that are larger than their chunk
+
+func newBufPool(max int) *bufPool {
+	p := &bufPool{}
+	for size := 1 << minBufClass; ; size <<= 1 {
+		p.classes = append(p.classes, sync.Pool{})
+		if size >= max {
+			break
+		}
+	}
+
+	return p
+}
+
+//class returns the index of the smallest size class that holds n bytes
+func (p *bufPool) class(n int) int {
+	c := 0
+	for size := 1 << minBufClass; size < n; size <<= 1 {
+		c++
+	}
+
+	return c
+}
+
+//get returns a buffer of length n
+func (p *bufPool) get(n int) []byte {
+	c := p.class(n)
+	if c >= len(p.classes) {
+		return make([]byte, n)
+	}
+
+	if b, ok := p.classes[c].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+
+	return make([]byte, n, 1<<uint(minBufClass+c))
+}
+
+//put hands a buffer that was returned by get back to the pool
+func (p *bufPool) put(b []byte) {
+	c := p.class(cap(b))
+	if c >= len(p.classes) || cap(b) != 1<<uint(minBufClass+c) {
+		return //not one of ours
+	}
+
+	b = b[:0]
+	p.classes[c].Put(&b)
+}
+
+//closed is a channel that is always closed, for items that are done from the start
+var closed = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+//sameBuffer returns whether two slices share their underlying array
+func sameBuffer(a, b []byte) bool {
+	return cap(a) > 0 && cap(b) > 0 && &a[:cap(a)][cap(a)-1] == &b[:cap(b)][cap(b)-1]
+}
@@ -0,0 +1,176 @@
+package s3sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//RefPrefix is prepended to the name of ref objects, it keeps them apart from chunks
+const RefPrefix = "refs/"
+
+//maxRefSize bounds the size of a ref object, refs are small
+const maxRefSize = 1 << 16
+
+//maxTagAttempts bounds how often a tag update is retried when it races with another writer
+const maxTagAttempts = 10
+
+var tagExp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+//Ref is a small mutable object that gives a snapshot a memorable name. Refs are stored as
+//plain text, so they hold nothing that the encrypted manifest of the snapshot doesn't
+type Ref struct {
+	Snapshot K         `json:"snapshot"`
+	Parent   K         `json:"parent"` //snapshot the ref pointed to before, if any
+	Updated  time.Time `json:"updated"`
+}
+
+//RefName returns the object name of the ref for the given tag
+func RefName(tag string) string {
+	return RefPrefix + tag
+}
+
+//ValidateTag returns an error if the tag can't be used to name a snapshot
+func ValidateTag(tag string) error {
+	if !tagExp.MatchString(tag) {
+		return fmt.Errorf("invalid tag '%s', it may only contain letters, digits, '.', '_' and '-'", tag)
+	}
+
+	if _, err := ParseK(tag); err == nil {
+		return fmt.Errorf("invalid tag '%s', it can't be told apart from a snapshot id", tag)
+	}
+
+	return nil
+}
+
+//GetRef fetches the ref for the given tag and the etag it is currently stored under,
+//a nil ref is returned if the tag doesn't exist
+func GetRef(ctx context.Context, s3 *S3, tag string) (ref *Ref, etag string, err error) {
+	resp, err := s3.GetObject(ctx, RefName(tag))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get ref: %v", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status for ref '%s': %v", tag, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRefSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read ref '%s': %v", tag, err)
+	} else if len(data) > maxRefSize {
+		return nil, "", fmt.Errorf("ref '%s' is larger than %d bytes", tag, maxRefSize)
+	}
+
+	ref = &Ref{}
+	err = json.Unmarshal(data, ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode ref '%s': %v", tag, err)
+	}
+
+	return ref, resp.Header.Get("ETag"), nil
+}
+
+//Tag points the given tag to snapshot 'id'. The update is a compare-and-swap on the
+//ref object so that concurrent writers never lose each others parent, stores that don't
+//support conditional writes fall back to a plain overwrite.
+func Tag(ctx context.Context, s3 *S3, tag string, id K) (err error) {
+	err = ValidateTag(tag)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < maxTagAttempts; i++ {
+		var old *Ref
+		var etag string
+		old, etag, err = GetRef(ctx, s3, tag)
+		if err != nil {
+			return err
+		}
+
+		ref := &Ref{Snapshot: id, Updated: time.Now()}
+		if old != nil {
+			ref.Parent = old.Snapshot
+		}
+
+		var data []byte
+		data, err = json.Marshal(ref)
+		if err != nil {
+			return fmt.Errorf("failed to encode ref: %v", err)
+		}
+
+		err = s3.PutObjectIf(ctx, RefName(tag), data, etag)
+		switch err {
+		case nil:
+			return nil
+		case ErrPreconditionFailed:
+			continue //someone else updated the tag in the meantime, try again
+		case ErrConditionalUnsupported:
+			return s3.PutObject(ctx, RefName(tag), data)
+		default:
+			return fmt.Errorf("failed to put ref '%s': %v", tag, err)
+		}
+	}
+
+	return fmt.Errorf("failed to update tag '%s' after %d attempts, it is being updated concurrently", tag, maxTagAttempts)
+}
+
+//ResolveSnapshot turns a snapshot id or a tag into a snapshot id
+func ResolveSnapshot(ctx context.Context, s3 *S3, name string) (id K, err error) {
+	id, err = ParseK(name)
+	if err == nil {
+		return id, nil
+	}
+
+	err = ValidateTag(name)
+	if err != nil {
+		return ZeroKey, fmt.Errorf("'%s' is neither a snapshot id nor a tag", name)
+	}
+
+	ref, _, err := GetRef(ctx, s3, name)
+	if err != nil {
+		return ZeroKey, err
+	}
+
+	if ref == nil {
+		return ZeroKey, fmt.Errorf("tag '%s' does not exist", name)
+	}
+
+	return ref.Snapshot, nil
+}
+
+//ListTags returns the refs of all tags stored in the bucket
+func ListTags(ctx context.Context, s3 *S3) (refs map[string]*Ref, err error) {
+	tags := []string{}
+	err = s3.List(ctx, RefPrefix, func(obj Object) error {
+		tags = append(tags, strings.TrimPrefix(obj.Name, RefPrefix))
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %v", err)
+	}
+
+	refs = map[string]*Ref{}
+	for _, tag := range tags {
+		ref, _, err := GetRef(ctx, s3, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		if ref != nil {
+			refs[tag] = ref
+		}
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,35 @@
+package s3sync
+
+import (
+	"context"
+	"fmt"
+)
+
+//Repair stores the chunks with the given keys anew, taking their content from the local
+//chunks. Any damaged object under those keys is overwritten. It returns the keys that were
+//repaired, keys that are not available locally are skipped.
+func Repair(ctx context.Context, keys []K, lc *LocalChunks, c *Codec, s3 *S3) (repaired map[K]bool, err error) {
+	repaired = map[K]bool{}
+	for _, k := range keys {
+		chunk, ok := lc.Get(k)
+		if !ok {
+			continue
+		}
+
+		obj, err := c.Encode(pool.get(len(chunk) + c.Overhead())[:0], chunk)
+		pool.put(chunk)
+		if err != nil {
+			return repaired, fmt.Errorf("failed to encode chunk '%x': %v", k, err)
+		}
+
+		err = s3.Put(ctx, k[:], obj)
+		pool.put(obj)
+		if err != nil {
+			return repaired, fmt.Errorf("failed to put chunk '%x': %v", k, err)
+		}
+
+		repaired[k] = true
+	}
+
+	return repaired, nil
+}
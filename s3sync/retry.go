@@ -0,0 +1,73 @@
+package s3sync
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//Retry configures how requests that failed transiently are retried
+type Retry struct {
+	MaxAttempts int           //total nr of attempts per request, zero or one disables retries
+	BaseDelay   time.Duration //delay before the first retry, doubled for every next one
+	MaxDelay    time.Duration //upper bound on the delay between two attempts
+}
+
+//backoff returns how long to wait after the given (zero based) attempt failed. It uses
+//"full jitter": a random duration up to the exponentially growing delay, so that many
+//concurrent workers don't hammer the store in lockstep.
+func (r Retry) backoff(attempt int) time.Duration {
+	d := r.BaseDelay
+	for i := 0; i < attempt && (r.MaxDelay <= 0 || d < r.MaxDelay); i++ {
+		d *= 2
+	}
+
+	if r.MaxDelay > 0 && d > r.MaxDelay {
+		d = r.MaxDelay
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+//retryable returns whether a request that ended with the given response or error is
+//worth another attempt: network errors, throttling and server side errors are
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+//retryAfter returns the delay requested by the Retry-After header of the response,
+//either as a nr of seconds or as a http date
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
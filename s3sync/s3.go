@@ -1,62 +1,99 @@
 package s3sync
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/smartystreets/go-aws-auth"
 )
 
-//S3 is A boring s3 client
+var (
+	//ErrPreconditionFailed is returned when a conditional write didn't match the stored object
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	//ErrConditionalUnsupported is returned when the store doesn't implement conditional writes
+	ErrConditionalUnsupported = errors.New("conditional writes are not supported by the store")
+)
+
+//Object describes an object that was found by listing the bucket
+type Object struct {
+	Name         string //name relative to the prefix of the client
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+//S3 is A boring s3 client. If no Bucket is configured the Host is expected to address
+//the bucket itself, e.g. a proxy or a bucket specific endpoint.
 type S3 struct {
-	Scheme string
-	Host   string
-	Prefix string
-	Client *http.Client
-	Creds  awsauth.Credentials
+	Scheme    string
+	Host      string
+	Bucket    string
+	Prefix    string
+	PathStyle bool //address the bucket as part of the path instead of the host name
+	Retry     Retry
+	Client    *http.Client
+	Creds     awsauth.Credentials
+}
+
+//BucketURL returns the url to the root of the bucket, taking path-style or
+//virtual-hosted-style addressing into account
+func (s3 *S3) BucketURL() string {
+	if s3.Bucket == "" {
+		return fmt.Sprintf("%s://%s", s3.Scheme, s3.Host)
+	}
+
+	if s3.PathStyle {
+		return fmt.Sprintf("%s://%s/%s", s3.Scheme, s3.Host, s3.Bucket)
+	}
+
+	return fmt.Sprintf("%s://%s.%s", s3.Scheme, s3.Bucket, s3.Host)
 }
 
 //KeyURL returns the url to a key based on s3 config
 func (s3 *S3) KeyURL(k []byte) string {
+	return s3.ObjectURL(fmt.Sprintf("%x", k))
+}
+
+//ObjectURL returns the url to an object with the given name based on s3 config
+func (s3 *S3) ObjectURL(name string) string {
 	if s3.Prefix == "" {
 		return fmt.Sprintf(
-			"%s://%s/%x",
-			s3.Scheme,
-			s3.Host, k)
+			"%s/%s",
+			s3.BucketURL(), name)
 	}
 
 	return fmt.Sprintf(
-		"%s://%s/%s/%x",
-		s3.Scheme,
-		s3.Host,
-		s3.Prefix, k)
+		"%s/%s/%s",
+		s3.BucketURL(),
+		s3.Prefix, name)
 }
 
 //Has attempts to download header info for an S3 k
-func (s3 *S3) Has(k []byte) (has bool, err error) {
-	raw := s3.KeyURL(k)
-	loc, err := url.Parse(raw)
-	if err != nil {
-		return false, fmt.Errorf("failed to parse '%s' as url: %v", raw, err)
-	}
-
-	req, err := http.NewRequest("HEAD", loc.String(), nil)
-	if err != nil {
-		return false, fmt.Errorf("failed to create HEAD request: %v", err)
-	}
-
-	if s3.Creds.AccessKeyID != "" {
-		awsauth.Sign(req, s3.Creds)
-	}
+func (s3 *S3) Has(ctx context.Context, k []byte) (has bool, err error) {
+	return s3.HasObject(ctx, fmt.Sprintf("%x", k))
+}
 
-	resp, err := s3.Client.Do(req)
+//HasObject attempts to download header info for the object with the given name
+func (s3 *S3) HasObject(ctx context.Context, name string) (has bool, err error) {
+	loc := s3.ObjectURL(name)
+	resp, err := s3.do(ctx, "HEAD", loc, nil, nil, true)
 	if err != nil {
-		return false, fmt.Errorf("failed to perform HEAD request: %v", err)
+		return false, err
 	}
 
+	resp.Body.Close()
 	if resp.StatusCode == http.StatusOK {
 		return true, nil
 	} else if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
@@ -69,61 +106,333 @@ func (s3 *S3) Has(k []byte) (has bool, err error) {
 }
 
 //Get attempts to download chunk 'k' from an S3 object store
-func (s3 *S3) Get(k []byte) (resp *http.Response, err error) {
-	raw := s3.KeyURL(k)
-	loc, err := url.Parse(raw)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse '%s' as url: %v", raw, err)
+func (s3 *S3) Get(ctx context.Context, k []byte) (resp *http.Response, err error) {
+	return s3.GetObject(ctx, fmt.Sprintf("%x", k))
+}
+
+//GetObject attempts to download the object with the given name
+func (s3 *S3) GetObject(ctx context.Context, name string) (resp *http.Response, err error) {
+	return s3.do(ctx, "GET", s3.ObjectURL(name), nil, nil, true)
+}
+
+//Put uploads a chunk to an S3 object store under the provided key 'k'
+func (s3 *S3) Put(ctx context.Context, k []byte, body []byte) error {
+	return s3.PutObject(ctx, fmt.Sprintf("%x", k), body)
+}
+
+//PutObject uploads an object under the given name
+func (s3 *S3) PutObject(ctx context.Context, name string, body []byte) error {
+	return s3.putObject(ctx, name, body, nil)
+}
+
+//PutObjectIf uploads an object under the given name, but only if the object currently
+//stored under that name has the given etag. An empty etag requires the object to not exist
+//at all. ErrPreconditionFailed is returned if the condition doesn't hold and
+//ErrConditionalUnsupported if the store doesn't support conditional writes.
+func (s3 *S3) PutObjectIf(ctx context.Context, name string, body []byte, etag string) error {
+	hdr := http.Header{}
+	if etag == "" {
+		hdr.Set("If-None-Match", "*")
+	} else {
+		hdr.Set("If-Match", etag)
 	}
 
-	req, err := http.NewRequest("GET", loc.String(), nil)
+	return s3.putObject(ctx, name, body, hdr)
+}
+
+//putObject uploads an object, conditional writes (with headers) are not retried as
+//a failed attempt might have succeeded and a retry would then fail its precondition
+func (s3 *S3) putObject(ctx context.Context, name string, body []byte, hdr http.Header) error {
+	loc := s3.ObjectURL(name)
+	resp, err := s3.do(ctx, "PUT", loc, body, hdr, hdr == nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GET request: %v", err)
+		return err
 	}
 
-	if s3.Creds.AccessKeyID != "" {
-		awsauth.Sign(req, s3.Creds)
+	defer resp.Body.Close()
+	if hdr != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	} else if hdr != nil && resp.StatusCode == http.StatusNotImplemented {
+		return ErrConditionalUnsupported
+	} else if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response body for unexpected response: %s", resp.Status)
+		}
+
+		return fmt.Errorf("unexpected response from PUT '%s' response: %s, body: %v", loc, resp.Status, string(body))
 	}
 
-	resp, err = s3.Client.Do(req)
+	return nil
+}
+
+//Delete removes chunk 'k' from an S3 object store
+func (s3 *S3) Delete(ctx context.Context, k []byte) error {
+	return s3.DeleteObject(ctx, fmt.Sprintf("%x", k))
+}
+
+//DeleteObject removes the object with the given name, removing an object that doesn't
+//exist is not an error
+func (s3 *S3) DeleteObject(ctx context.Context, name string) error {
+	loc := s3.ObjectURL(name)
+	resp, err := s3.do(ctx, "DELETE", loc, nil, nil, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to perform GET request: %v", err)
+		return err
 	}
 
-	return resp, nil
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response body for unexpected response: %s", resp.Status)
+		}
+
+		return fmt.Errorf("unexpected response from DELETE '%s' response: %s, body: %v", loc, resp.Status, string(body))
+	}
+
+	return nil
 }
 
-//Put uploads a chunk to an S3 object store under the provided key 'k'
-func (s3 *S3) Put(k []byte, body io.Reader) error {
-	raw := s3.KeyURL(k)
+//MaxDeleteObjects is the nr of objects that can be removed by a single DeleteObjects call
+const MaxDeleteObjects = 1000
+
+type deleteRequest struct {
+	XMLName xml.Name       `xml:"Delete"`
+	Quiet   bool           `xml:"Quiet"`
+	Objects []deleteObject `xml:"Object"`
+}
+
+type deleteObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteResult struct {
+	Errors []struct {
+		Key     string
+		Code    string
+		Message string
+	} `xml:"Error"`
+}
+
+//DeleteObjects removes the objects with the given names using as few requests as possible.
+//Stores that don't support batch deletes get a request per object.
+func (s3 *S3) DeleteObjects(ctx context.Context, names []string) error {
+	base := ""
+	if s3.Prefix != "" {
+		base = s3.Prefix + "/"
+	}
+
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > MaxDeleteObjects {
+			batch = batch[:MaxDeleteObjects]
+		}
+
+		names = names[len(batch):]
+		req := deleteRequest{Quiet: true}
+		for _, name := range batch {
+			req.Objects = append(req.Objects, deleteObject{Key: base + name})
+		}
+
+		body, err := xml.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("failed to encode delete request: %v", err)
+		}
+
+		sum := md5.Sum(body)
+		hdr := http.Header{}
+		hdr.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		hdr.Set("Content-Type", "application/xml")
+
+		loc := fmt.Sprintf("%s/?delete", s3.BucketURL())
+		resp, err := s3.do(ctx, "POST", loc, body, hdr, true)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusNotImplemented {
+			resp.Body.Close()
+			for _, name := range batch {
+				if err = s3.DeleteObject(ctx, name); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		res := &deleteResult{}
+		if resp.StatusCode == http.StatusOK {
+			err = xml.NewDecoder(resp.Body).Decode(res)
+		} else {
+			var data []byte
+			data, err = ioutil.ReadAll(resp.Body)
+			if err == nil {
+				err = fmt.Errorf("unexpected response from delete '%s' request: %s, body: %v", loc, resp.Status, string(data))
+			}
+		}
+
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %v", err)
+		}
+
+		if len(res.Errors) > 0 {
+			e := res.Errors[0]
+			return fmt.Errorf("failed to delete %d objects, e.g '%s': %s: %s", len(res.Errors), strings.TrimPrefix(e.Key, base), e.Code, e.Message)
+		}
+	}
+
+	return nil
+}
+
+//do performs a signed request. Idempotent requests that fail on a transient network
+//error or throttling/server response are retried according to the retry configuration,
+//after the final attempt the last response is returned as is.
+func (s3 *S3) do(ctx context.Context, method, raw string, body []byte, hdr http.Header, idempotent bool) (resp *http.Response, err error) {
 	loc, err := url.Parse(raw)
 	if err != nil {
-		return fmt.Errorf("failed to parse '%s' as url: %v", raw, err)
+		return nil, fmt.Errorf("failed to parse '%s' as url: %v", raw, err)
+	}
+
+	attempts := s3.Retry.MaxAttempts
+	if attempts < 1 || !idempotent {
+		attempts = 1
+	}
+
+	for i := 0; ; i++ {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body) //each attempt reads the body anew
+		}
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, loc.String(), r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s request: %v", method, err)
+		}
+
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+
+		if s3.Creds.AccessKeyID != "" {
+			awsauth.Sign(req, s3.Creds)
+		}
+
+		resp, err = s3.Client.Do(req)
+		if i+1 >= attempts || !retryable(resp, err) {
+			break
+		}
+
+		wait := s3.Retry.backoff(i)
+		if resp != nil {
+			if after := retryAfter(resp); after > wait {
+				wait = after
+			}
+
+			if s3.Retry.MaxDelay > 0 && wait > s3.Retry.MaxDelay {
+				wait = s3.Retry.MaxDelay //servers don't get to stall requests beyond the configured limit
+			}
+
+			io.Copy(ioutil.Discard, resp.Body) //allow the connection to be reused
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	req, err := http.NewRequest("PUT", loc.String(), body)
 	if err != nil {
-		return fmt.Errorf("failed to create PUT request: %v", err)
+		return nil, fmt.Errorf("failed to perform %s request: %v", method, err)
 	}
 
-	if s3.Creds.AccessKeyID != "" {
-		awsauth.Sign(req, s3.Creds)
+	return resp, nil
+}
+
+//List calls fn for every object whose name starts with the given prefix. It uses the
+//ListObjectsV2 api and follows continuation tokens until all pages are read or fn returns
+//an error, which is then returned as is.
+func (s3 *S3) List(ctx context.Context, prefix string, fn func(obj Object) error) (err error) {
+	base := ""
+	if s3.Prefix != "" {
+		base = s3.Prefix + "/"
 	}
 
-	resp, err := s3.Client.Do(req)
+	token := ""
+	for {
+		var page *listPage
+		page, err = s3.listPage(ctx, base+prefix, token)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range page.Contents {
+			obj := Object{
+				Name:         strings.TrimPrefix(c.Key, base),
+				Size:         c.Size,
+				LastModified: c.LastModified,
+				ETag:         c.ETag,
+			}
+
+			if err = fn(obj); err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+
+		token = page.NextContinuationToken
+	}
+}
+
+type listPage struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+//listPage retrieves a single page of object names that start with the (full) prefix
+func (s3 *S3) listPage(ctx context.Context, prefix, token string) (page *listPage, err error) {
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("prefix", prefix)
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+
+	loc := fmt.Sprintf("%s/?%s", s3.BucketURL(), q.Encode())
+	resp, err := s3.do(ctx, "GET", loc, nil, nil, true)
 	if err != nil {
-		return fmt.Errorf("failed to perform PUT request: %v", err)
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return fmt.Errorf("failed to read response body for unexpected response: %s", resp.Status)
+			return nil, fmt.Errorf("failed to read response body for unexpected response: %s", resp.Status)
 		}
 
-		return fmt.Errorf("unexpected response from PUT '%s' response: %s, body: %v", loc, resp.Status, string(body))
+		return nil, fmt.Errorf("unexpected response from list '%s' request: %s, body: %v", loc, resp.Status, string(body))
 	}
 
-	return nil
+	page = &listPage{}
+	err = xml.NewDecoder(resp.Body).Decode(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode list response: %v", err)
+	}
+
+	return page, nil
 }
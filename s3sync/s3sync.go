@@ -1,11 +1,40 @@
 package s3sync
 
-import "crypto/sha256"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
 
 type K [sha256.Size]byte
 
 var ZeroKey = K{}
 
+//ParseK decodes a hex encoded key
+func ParseK(s string) (k K, err error) {
+	if hex.DecodedLen(len(s)) != len(k) {
+		return ZeroKey, fmt.Errorf("expected %d hex encoded bytes, got '%s'", len(k), s)
+	}
+
+	_, err = hex.Decode(k[:], []byte(s))
+	if err != nil {
+		return ZeroKey, fmt.Errorf("failed to decode '%s': %v", s, err)
+	}
+
+	return k, nil
+}
+
+//MarshalText encodes the key as hex
+func (k K) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(k[:])), nil
+}
+
+//UnmarshalText decodes a hex encoded key
+func (k *K) UnmarshalText(text []byte) (err error) {
+	*k, err = ParseK(string(text))
+	return err
+}
+
 type KeyWriter interface {
 	Write(k K) error
 }
@@ -2,60 +2,236 @@ package s3sync
 
 import (
 	"archive/tar"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 )
 
-//Tar archives the given directory and writes bytes to
-func Tar(dir string, w io.Writer) (err error) {
-	tw := tar.NewWriter(w)
-	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
-		if fi.Mode().IsDir() {
-			return nil
+//TarOpts configures a Tar
+type TarOpts struct {
+	Excludes       []string              //gitignore-style patterns of paths to leave out, relative to the directory
+	Includes       []string              //patterns of paths to archive even if they are excluded elsewhere, but not below an excluded directory
+	MaxFileSize    int64                 //regular files larger than this are left out, zero means no limit
+	OneFileSystem  bool                  //the content of directories on another file system than the directory is left out
+	FollowSymlinks bool                  //symlinks are archived as the file or directory they point to, unless that would loop
+	MaxDepth       int                   //the content of directories this deep is left out, zero means no limit
+	Skipped        func(rel, why string) //called with the slash separated path of everything that is left out, if not nil
+}
+
+//Tar archives the given directory and writes bytes to, it stops early when the context
+//is cancelled. Besides regular files it archives directories, symlinks, hardlinks, FIFOs
+//and devices together with their ownership and, where supported, extended attributes.
+//Symlinks are archived as links unless they are to be followed. Sockets are skipped as
+//they can't be restored. Entries are archived in lexical order and the archive only
+//depends on the content and metadata of the directory, so an unchanged directory results
+//in the same archive and thus in the same chunks. Paths are left out as configured by the
+//options and by '.s3syncignore' files in the directory, these hold gitignore-style
+//patterns relative to the directory they are in.
+func Tar(ctx context.Context, dir string, w io.Writer, opts TarOpts) (err error) {
+	t := &tarWalker{ctx: ctx, opts: opts, tw: tar.NewWriter(w), links: map[inodeID]string{}}
+	t.ig, err = newIgnorer(opts.Excludes, opts.Includes)
+	if err != nil {
+		return err
+	}
+
+	root, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to inspect dir '%s': %v", dir, err)
+	}
+
+	t.dev, _ = device(root)
+	err = t.walkDir(dir, ".", root, 0)
+	if err != nil {
+		return fmt.Errorf("failed to walk dir '%s': %v", dir, err)
+	}
+
+	if err = t.tw.Close(); err != nil {
+		return fmt.Errorf("failed to write remaining data: %v", err)
+	}
+
+	return nil
+}
+
+//tarWalker holds the state of a Tar while it walks the directory
+type tarWalker struct {
+	ctx       context.Context
+	opts      TarOpts
+	ig        *ignorer
+	tw        *tar.Writer
+	links     map[inodeID]string //name of the first entry of every file with several links
+	dev       uint64             //device of the directory that is archived
+	ancestors []os.FileInfo      //directories that are being walked, to detect followed symlinks that loop
+}
+
+//skip reports that the entry rel is left out
+func (t *tarWalker) skip(rel, why string) {
+	if t.opts.Skipped != nil {
+		t.opts.Skipped(rel, why)
+	}
+}
+
+//walkDir archives the entries of directory path in lexical order, depth is the nr of
+//path elements in rel
+func (t *tarWalker) walkDir(path, rel string, fi os.FileInfo, depth int) error {
+	if err := t.ig.load(path, rel); err != nil {
+		return fmt.Errorf("failed to load excludes of '%s': %v", rel, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open dir '%s': %v", rel, err)
+	}
+
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read dir '%s': %v", rel, err)
+	}
+
+	sort.Strings(names)
+	t.ancestors = append(t.ancestors, fi)
+	defer func() { t.ancestors = t.ancestors[:len(t.ancestors)-1] }()
+	for _, name := range names {
+		crel := name
+		if rel != "." {
+			crel = rel + "/" + name
 		}
 
-		rel, err := filepath.Rel(dir, path)
+		cpath := filepath.Join(path, name)
+		cfi, err := os.Lstat(cpath)
 		if err != nil {
-			return fmt.Errorf("failed to determine path '%s' relative to '%s': %v", path, dir, err)
+			return fmt.Errorf("failed to inspect '%s': %v", crel, err)
 		}
 
-		f, err := os.Open(path)
+		err = t.entry(cpath, crel, cfi, depth+1)
 		if err != nil {
-			return fmt.Errorf("failed to open file '%s': %v", rel, err)
+			return err
 		}
+	}
 
-		err = tw.WriteHeader(&tar.Header{
-			Name:    rel,
-			Mode:    int64(fi.Mode()),
-			ModTime: fi.ModTime(),
-			Size:    fi.Size(),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to write tar header for '%s': %v", rel, err)
+	return nil
+}
+
+//entry archives a single entry, and the content of directories
+func (t *tarWalker) entry(path, rel string, fi os.FileInfo, depth int) (err error) {
+	if err = t.ctx.Err(); err != nil {
+		return err
+	}
+
+	target := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if tfi, err := os.Stat(path); err == nil && t.opts.FollowSymlinks && !t.loops(tfi) {
+			fi = tfi //archived as what it points to, dangling symlinks are kept as is
+		} else if target, err = os.Readlink(path); err != nil {
+			return fmt.Errorf("failed to read symlink '%s': %v", rel, err)
 		}
+	}
 
-		defer f.Close()
-		n, err := io.Copy(tw, f)
-		if err != nil {
-			return fmt.Errorf("failed to write tar file for '%s': %v", rel, err)
+	switch {
+	case fi.Mode()&os.ModeSocket != 0:
+		t.skip(rel, "socket")
+		return nil
+	case t.ig.excluded(rel, fi.IsDir()):
+		t.skip(rel, "excluded")
+		return nil
+	case t.opts.MaxFileSize > 0 && fi.Mode().IsRegular() && fi.Size() > t.opts.MaxFileSize:
+		t.skip(rel, "too large")
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return fmt.Errorf("failed to create tar header for '%s': %v", rel, err)
+	}
+
+	hdr.Name = rel
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+
+	hdr.Format = tar.FormatPAX //preserves sub-second modification times, long names and xattrs
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{} //both change without the content changing
+	err = readXattrs(path, hdr)
+	if err != nil {
+		return fmt.Errorf("failed to read extended attributes of '%s': %v", rel, err)
+	}
+
+	if id, nlink, ok := inode(fi); ok && fi.Mode().IsRegular() && nlink > 1 {
+		if first, ok := t.links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			t.links[id] = hdr.Name
 		}
+	}
 
-		if n != fi.Size() {
-			return fmt.Errorf("unexpected nr of bytes written to tar, saw '%d' on-disk but only wrote '%d', is directory '%s' in use?", fi.Size(), n, dir)
+	err = t.tw.WriteHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("failed to write tar header for '%s': %v", rel, err)
+	}
+
+	if fi.IsDir() {
+		if dev, ok := device(fi); t.opts.OneFileSystem && ok && dev != t.dev {
+			t.skip(rel, "content is on another file system")
+			return nil
+		} else if t.opts.MaxDepth > 0 && depth >= t.opts.MaxDepth {
+			t.skip(rel, "content is deeper than the max depth")
+			return nil
 		}
 
+		return t.walkDir(path, rel, fi, depth)
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
 		return nil
-	})
+	}
 
+	f, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to walk dir '%s': %v", dir, err)
+		return fmt.Errorf("failed to open file '%s': %v", rel, err)
 	}
 
-	if err = tw.Close(); err != nil {
-		return fmt.Errorf("failed to write remaining data: %v", err)
+	defer f.Close()
+	n, err := io.Copy(t.tw, &ctxReader{t.ctx, f})
+	if err != nil {
+		return fmt.Errorf("failed to write tar file for '%s': %v", rel, err)
+	}
+
+	if n != fi.Size() {
+		return fmt.Errorf("unexpected nr of bytes written to tar, saw '%d' on-disk but only wrote '%d', is '%s' in use?", fi.Size(), n, rel)
 	}
 
 	return nil
 }
+
+//loops returns whether fi is one of the directories that are being walked, following a
+//symlink to it would never end
+func (t *tarWalker) loops(fi os.FileInfo) bool {
+	for _, a := range t.ancestors {
+		if os.SameFile(a, fi) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//ctxReader stops reading once its context is cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (n int, err error) {
+	if err = cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
@@ -0,0 +1,184 @@
+//go:build linux
+// +build linux
+
+package s3sync
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	//atFDCWD makes utimensat resolve relative paths against the working directory
+	atFDCWD = -0x64
+
+	//atSymlinkNofollow makes utimensat change the symlink instead of the file it points to
+	atSymlinkNofollow = 0x100
+)
+
+//xattrPrefix prefixes the PAX records that hold extended attributes, as written by GNU tar
+const xattrPrefix = "SCHILY.xattr."
+
+//inodeID identifies a file on a device, entries with the same id are hardlinks
+type inodeID struct {
+	dev uint64
+	ino uint64
+}
+
+//inode returns the id and nr of links of a file
+func inode(fi os.FileInfo) (id inodeID, nlink uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return id, 0, false
+	}
+
+	return inodeID{uint64(st.Dev), uint64(st.Ino)}, uint64(st.Nlink), true
+}
+
+//device returns the id of the device a file is on
+func device(fi os.FileInfo) (dev uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(st.Dev), true
+}
+
+//readXattrs records the extended attributes of a file in the header, those of symlinks are
+//not read since they can't be set on most filesystems
+func readXattrs(path string, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	names, err := xattrList(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		val, err := xattrGet(path, name)
+		if err == syscall.ENODATA {
+			continue //removed in the mean time
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+
+		hdr.PAXRecords[xattrPrefix+name] = string(val)
+	}
+
+	return nil
+}
+
+//writeXattrs sets the extended attributes recorded in the header. Attributes that the
+//filesystem or the user is not allowed to set, e.g those in the trusted namespace for
+//anyone but root, are skipped
+func writeXattrs(path string, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	for key, val := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+
+		err := syscall.Setxattr(path, strings.TrimPrefix(key, xattrPrefix), []byte(val), 0)
+		if err == syscall.ENOTSUP || err == syscall.EPERM {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//xattrList returns the sorted names of the extended attributes of a file
+func xattrList(path string) (names []string, err error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		} else if err == syscall.ENOTSUP {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+
+		sort.Strings(names)
+		return names, nil
+	}
+}
+
+//xattrGet returns the value of an extended attribute
+func xattrGet(path, name string) (val []byte, err error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+}
+
+//mknod creates a FIFO or device file for the header
+func mknod(path string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	}
+
+	dev := (hdr.Devmajor&0xfff)<<8 | hdr.Devminor&0xff | (hdr.Devminor&^0xff)<<12 | (hdr.Devmajor&^0xfff)<<32
+	return syscall.Mknod(path, mode, int(dev))
+}
+
+//lchtimes changes the modification time of a symlink itself, instead of the file it points to
+func lchtimes(path string, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(time.Now().UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	fd := atFDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
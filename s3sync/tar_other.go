@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+package s3sync
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"time"
+)
+
+//inodeID identifies a file on a device, entries with the same id are hardlinks
+type inodeID struct{}
+
+//inode is not implemented on this platform, hardlinks are archived as separate files
+func inode(fi os.FileInfo) (id inodeID, nlink uint64, ok bool) {
+	return id, 0, false
+}
+
+//device is not implemented on this platform, directories on other file systems are walked
+func device(fi os.FileInfo) (dev uint64, ok bool) {
+	return 0, false
+}
+
+//readXattrs is not implemented on this platform
+func readXattrs(path string, hdr *tar.Header) error {
+	return nil
+}
+
+//writeXattrs is not implemented on this platform, recorded attributes are not restored
+func writeXattrs(path string, hdr *tar.Header) error {
+	return nil
+}
+
+//mknod is not implemented on this platform
+func mknod(path string, hdr *tar.Header) error {
+	return fmt.Errorf("special files are not supported on this platform")
+}
+
+//lchtimes is not implemented on this platform, symlinks keep the time they were created
+func lchtimes(path string, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,374 @@
+package s3sync
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dchest/safefile"
+)
+
+//UntarError describes a tar entry that could not be extracted
+type UntarError struct {
+	Name string //name of the entry in the archive
+	Op   string //operation that failed
+	Err  error
+}
+
+func (e *UntarError) Error() string {
+	return fmt.Sprintf("failed to %s '%s': %v", e.Op, e.Name, e.Err)
+}
+
+//UntarOpts configures the extraction of an archive
+type UntarOpts struct {
+	Prune bool //remove what is in the directory but not in the archive
+}
+
+//Untar extracts a tar stream into the given directory. Files are written atomically and
+//directories are created as needed, whatever is in the way of an entry, such as a file
+//where the archive has a directory, is replaced. Modes, modification times and extended
+//attributes are restored, as is ownership when running as root. Symlinks are created
+//after all other entries and no entry is written through a symlink, so an archive can't
+//place files outside of the directory.
+func Untar(dir string, r io.Reader, opts UntarOpts) (err error) {
+	type deferred struct {
+		path string
+		hdr  *tar.Header
+	}
+
+	dirs := []deferred{}
+	symlinks := []deferred{}
+	root := filepath.Clean(dir)
+	checked := map[string]bool{root: true} //directories that are known not to be symlinks
+	extracted := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return fmt.Errorf("failed to read next tar header: %v", err)
+		}
+
+		path, err := untarPath(dir, hdr.Name)
+		if err != nil {
+			return &UntarError{hdr.Name, "resolve path for", err}
+		}
+
+		if path == root {
+			if hdr.Typeflag == tar.TypeDir {
+				continue //such as the './' entry of 'tar -C dir .', the directory keeps its own attributes
+			}
+
+			return &UntarError{hdr.Name, "extract", fmt.Errorf("entry is the directory itself")}
+		}
+
+		extracted[path] = true
+
+		err = untarParents(dir, filepath.Dir(path), checked)
+		if err != nil {
+			return &UntarError{hdr.Name, "create parent directories for", err}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = untarParents(dir, path, checked)
+			if err != nil {
+				return &UntarError{hdr.Name, "create directory", err}
+			}
+
+			//modes and times are set when all content is written, else a read-only
+			//directory can't be filled and writing content would change its mtime
+			dirs = append(dirs, deferred{path, hdr})
+			continue
+		case tar.TypeSymlink:
+			symlinks = append(symlinks, deferred{path, hdr})
+			continue
+		case tar.TypeLink:
+			err = untarLink(dir, path, hdr)
+			if err != nil {
+				return err
+			}
+
+			continue //shares its attributes with the file it links to
+		case tar.TypeReg, tar.TypeRegA:
+			err = untarFile(path, hdr, tr)
+		case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+			if err = untarRemove(path); err == nil {
+				err = mknod(path, hdr)
+			}
+
+			if err != nil {
+				err = &UntarError{hdr.Name, "create special file", err}
+			}
+		default:
+			err = &UntarError{hdr.Name, "extract", fmt.Errorf("unsupported entry type '%c'", hdr.Typeflag)}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = untarAttrs(path, hdr)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, l := range symlinks {
+		if checked[l.path] {
+			return &UntarError{l.hdr.Name, "create symlink", fmt.Errorf("archive has entries below it")}
+		}
+
+		err = untarRemove(l.path)
+		if err == nil {
+			err = os.Symlink(l.hdr.Linkname, l.path)
+		}
+
+		if err != nil {
+			return &UntarError{l.hdr.Name, "create symlink", err}
+		}
+
+		err = untarAttrs(l.path, l.hdr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Prune {
+		for path := range checked {
+			extracted[path] = true //parents that the archive has no entries for
+		}
+
+		err = untarPrune(root, extracted)
+		if err != nil {
+			return fmt.Errorf("failed to remove what is not in the archive: %v", err)
+		}
+	}
+
+	//deepest directories first, so restoring a parent doesn't get in the way
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].path > dirs[j].path })
+	for _, d := range dirs {
+		err = untarAttrs(d.path, d.hdr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//untarAttrs restores the ownership, extended attributes, mode and modification time of
+//an entry. The mode is set after the ownership, since changing the owner clears the
+//setuid and setgid bits. Only ownership and times are restored for symlinks
+func untarAttrs(path string, hdr *tar.Header) (err error) {
+	if os.Geteuid() == 0 {
+		err = os.Lchown(path, hdr.Uid, hdr.Gid)
+		if err != nil {
+			return &UntarError{hdr.Name, "change owner of", err}
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeSymlink {
+		err = lchtimes(path, hdr.ModTime)
+		if err != nil {
+			return &UntarError{hdr.Name, "change times of", err}
+		}
+
+		return nil
+	}
+
+	err = writeXattrs(path, hdr)
+	if err != nil {
+		return &UntarError{hdr.Name, "set extended attributes of", err}
+	}
+
+	err = os.Chmod(path, untarMode(hdr))
+	if err != nil {
+		return &UntarError{hdr.Name, "change mode of", err}
+	}
+
+	err = os.Chtimes(path, time.Now(), hdr.ModTime)
+	if err != nil {
+		return &UntarError{hdr.Name, "change times of", err}
+	}
+
+	return nil
+}
+
+//untarParents creates the directory at path and any of its parents below dir. Existing
+//directories are checked not to be symlinks, which could redirect entries to outside of
+//dir, a symlink or file in the way is replaced by a directory. Directories that passed
+//the check are remembered. Dir itself and anything above it is left alone.
+func untarParents(dir, path string, checked map[string]bool) error {
+	if checked[path] {
+		return nil
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	} else if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	err = untarParents(dir, filepath.Dir(path), checked)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(path)
+	switch {
+	case err == nil && fi.IsDir():
+	case err == nil: //such as where an older version of the directory had a file
+		if err = os.Remove(path); err == nil {
+			err = os.Mkdir(path, 0777)
+		}
+	case os.IsNotExist(err):
+		err = os.Mkdir(path, 0777)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	checked[path] = true
+	return nil
+}
+
+//untarLink creates a hardlink to an entry that was extracted before
+func untarLink(dir, path string, hdr *tar.Header) error {
+	target, err := untarPath(dir, hdr.Linkname)
+	if err != nil {
+		return &UntarError{hdr.Name, "resolve link target for", err}
+	}
+
+	err = untarRemove(path)
+	if err == nil {
+		err = os.Link(target, path)
+	}
+
+	if err != nil {
+		return &UntarError{hdr.Name, "create hardlink", err}
+	}
+
+	return nil
+}
+
+//untarRemove removes whatever is at path, such that a new entry can be created there. A
+//directory is removed with all of its content
+func untarRemove(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return os.RemoveAll(path)
+	}
+
+	return os.Remove(path)
+}
+
+//untarPrune removes everything below dir that is not to be kept, directories are
+//removed with all of their content. Dir itself may be a symlink, so its entries are
+//listed before walking them
+func untarPrune(dir string, keep map[string]bool) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		err = filepath.Walk(filepath.Join(dir, fi.Name()), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if keep[path] {
+				return nil
+			}
+
+			err = os.RemoveAll(path)
+			if err != nil {
+				return err
+			}
+
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//untarFile atomically writes the content of a regular file entry to path, a file can't
+//be swapped for a directory so that is removed first
+func untarFile(path string, hdr *tar.Header, r io.Reader) (err error) {
+	if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return &UntarError{hdr.Name, "remove directory in place of", err}
+		}
+	}
+
+	f, err := safefile.Create(path, untarMode(hdr))
+	if err != nil {
+		return &UntarError{hdr.Name, "create tmp safe file for", err}
+	}
+
+	defer f.Close()
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return &UntarError{hdr.Name, "write content to tmp file of", err}
+	}
+
+	if n != hdr.Size {
+		return &UntarError{hdr.Name, "write", fmt.Errorf("unexpected nr of bytes written, wrote '%d' saw '%d' in tar hdr", n, hdr.Size)}
+	}
+
+	err = f.Commit()
+	if err != nil {
+		return &UntarError{hdr.Name, "swap old file for tmp file of", err}
+	}
+
+	return nil
+}
+
+//untarMode returns the permission bits of a tar header
+func untarMode(hdr *tar.Header) os.FileMode {
+	return hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+//untarPath returns where an entry should be extracted, it refuses names that would
+//end up outside of the directory
+func untarPath(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", err
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path is outside of directory '%s'", dir)
+	}
+
+	return path, nil
+}
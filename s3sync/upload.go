@@ -1,91 +1,347 @@
 package s3sync
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/restic/chunker"
 )
 
-//Upload pushes chunks to s3 and writes them
-func Upload(cr *chunker.Chunker, kw KeyWriter, concurrency int, s3 *S3) (err error) {
-	type result struct {
-		err error
-		k   K
+//UploadOpts configures an Upload
+type UploadOpts struct {
+	Limits
+	Codec  *Codec       //names and encodes chunks, nil stores them as is under their SHA-256
+	Index  *Index       //keys in the index are not checked for existence, stored keys are added to it
+	Known  map[K]bool   //keys that are stored, e.g as listed by ListKeys. If set, no other key is checked for existence but assumed missing
+	Lister *KeyLister   //lists the keys that are stored alongside the upload, they are used as Known once complete
+	Stats  *UploadStats //counts what the upload did, if not nil
+}
+
+//UploadStats counts what an upload did
+type UploadStats struct {
+	Chunks        int64 //nr of chunks in the stream
+	Bytes         int64 //nr of bytes in the stream
+	Indexed       int64 //nr of chunks that were known to be stored by the index
+	Uploaded      int64 //nr of chunks that were not yet stored and thus uploaded
+	UploadedBytes int64 //nr of chunk bytes that were uploaded
+	StoredBytes   int64 //nr of object bytes that were uploaded, after encoding
+}
+
+//Ratio returns the size of the uploaded objects relative to the size of their chunks
+func (st *UploadStats) Ratio() float64 {
+	if st.UploadedBytes == 0 {
+		return 1
+	}
+
+	return float64(st.StoredBytes) / float64(st.UploadedBytes)
+}
+
+//ErrTooManyKeys is returned by ListKeys when the store holds more objects than allowed
+var ErrTooManyKeys = errors.New("too many objects to list")
+
+//ListKeys lists the keys of all chunks that are stored. Listing stops with ErrTooManyKeys
+//once more than max objects are seen, which allows a caller to fall back to checking the
+//existence of chunks one by one when that is cheaper. A negative max lists everything.
+func ListKeys(ctx context.Context, s3 *S3, max int) (keys map[K]bool, err error) {
+	n := 0
+	keys = map[K]bool{}
+	err = s3.List(ctx, "", func(obj Object) error {
+		if n++; max >= 0 && n > max {
+			return ErrTooManyKeys
+		}
+
+		if k, err := ParseK(obj.Name); err == nil {
+			keys[k] = true
+		}
+
+		return nil
+	})
+
+	if err == ErrTooManyKeys {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %v", err)
+	}
+
+	return keys, nil
+}
+
+const (
+	//listPageSize is the nr of objects that is listed per request
+	listPageSize = 1000
+
+	//listPageCost is the nr of existence checks that cost about as much as listing a page,
+	//pages are more expensive requests and, unlike existence checks, are read one by one
+	listPageCost = 16
+)
+
+//ListLimit returns the nr of objects up to which listing them all is expected to be cheaper
+//than checking the existence of n chunks one by one
+func ListLimit(n int64) int {
+	return int(n * listPageSize / listPageCost)
+}
+
+//KeyLister lists the keys of stored chunks alongside an upload, for when it is not known up
+//front how many chunks the upload checks. A page is only listed once the upload has seen
+//enough chunks to pay for it, so listing never costs much more than the existence checks
+//it replaces. Until the listing is complete the upload checks chunks one by one.
+type KeyLister struct {
+	mu     sync.Mutex
+	seen   int64 //nr of chunks whose existence had to be checked
+	keys   map[K]bool
+	done   bool //all keys are listed
+	sig    chan struct{}
+	cancel func()
+	doneCh chan struct{}
+	err    error
+}
+
+//ListKeysLazily starts listing the keys of stored chunks at the pace of an upload that
+//reports the chunks it sees. It must be closed to stop listing.
+func ListKeysLazily(ctx context.Context, s3 *S3) (kl *KeyLister) {
+	kl = &KeyLister{keys: map[K]bool{}, sig: make(chan struct{}, 1), doneCh: make(chan struct{})}
+	ctx, kl.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(kl.doneCh)
+		kl.err = kl.list(ctx, s3)
+	}()
+
+	return kl
+}
+
+func (kl *KeyLister) list(ctx context.Context, s3 *S3) error {
+	base := ""
+	if s3.Prefix != "" {
+		base = s3.Prefix + "/"
 	}
 
+	token := ""
+	for pages := int64(0); ; pages++ {
+		for {
+			kl.mu.Lock()
+			paid := kl.seen >= pages*listPageCost
+			kl.mu.Unlock()
+			if paid {
+				break
+			}
+
+			select {
+			case <-kl.sig:
+			case <-ctx.Done():
+				return nil //stopped before the listing paid off
+			}
+		}
+
+		page, err := s3.listPage(ctx, base, token)
+		if ctx.Err() != nil {
+			return nil //stopped while a page was listed
+		} else if err != nil {
+			return fmt.Errorf("failed to list keys: %v", err)
+		}
+
+		kl.mu.Lock()
+		for _, c := range page.Contents {
+			if k, err := ParseK(strings.TrimPrefix(c.Key, base)); err == nil {
+				kl.keys[k] = true
+			}
+		}
+
+		kl.done = !page.IsTruncated || page.NextContinuationToken == ""
+		kl.mu.Unlock()
+		if kl.done {
+			return nil
+		}
+
+		token = page.NextContinuationToken
+	}
+}
+
+//Seen reports that the existence of another chunk has to be checked
+func (kl *KeyLister) Seen() {
+	if kl == nil {
+		return
+	}
+
+	kl.mu.Lock()
+	kl.seen++
+	kl.mu.Unlock()
+	select {
+	case kl.sig <- struct{}{}:
+	default: //a wakeup is already pending
+	}
+}
+
+//Known returns the keys that are stored once all of them are listed, it returns nil
+//before that. The returned keys must not be modified.
+func (kl *KeyLister) Known() map[K]bool {
+	if kl == nil {
+		return nil
+	}
+
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if !kl.done {
+		return nil
+	}
+
+	return kl.keys
+}
+
+//Close stops listing and returns the error that stopped it early, if any
+func (kl *KeyLister) Close() error {
+	kl.cancel()
+	<-kl.doneCh
+	return kl.err
+}
+
+//Upload pushes chunks to s3 and writes them. When an error occurs, or the context is
+//cancelled, in-flight requests are cancelled and no goroutine is left blocked. The
+//chunker's reader is not closed, a caller streaming into it should close it on error
+func Upload(ctx context.Context, cr *chunker.Chunker, kw KeyWriter, opts UploadOpts, s3 *S3) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	type item struct {
 		chunk []byte
-		resCh chan *result
+		k     K
 		err   error
+		done  chan struct{}
 	}
 
+	st := opts.Stats
+	if st == nil {
+		st = &UploadStats{}
+	}
+
+	//whether a chunk is encoded is only known once its existence is checked, so the
+	//buffers for encoding it are acquired along with the chunk and released when done
+	lim := opts.Limits.withDefaults(int64(chunker.MaxSize + opts.Codec.encodeSize(chunker.MaxSize)))
+	bud := newBudget(lim.MaxInFlight)
 	work := func(it *item) {
-		var exists bool
-		k := sha256.Sum256(it.chunk) //hash
-		exists, err = s3.Has(k[:])   //check existence
-		if err != nil {
-			it.resCh <- &result{fmt.Errorf("failed to check existence of '%x': %v", k, err), ZeroKey}
+		defer close(it.done)
+		defer bud.release(int64(len(it.chunk) + opts.Codec.encodeSize(len(it.chunk))))
+		defer pool.put(it.chunk)
+
+		it.k = opts.Codec.Key(it.chunk) //hash
+		if opts.Index.Has(it.k) {
+			atomic.AddInt64(&st.Indexed, 1)
 			return
 		}
 
+		known := opts.Known
+		if known == nil {
+			known = opts.Lister.Known()
+		}
+
+		exists := known[it.k]
+		if known == nil {
+			opts.Lister.Seen()
+			var err error
+			exists, err = s3.Has(ctx, it.k[:]) //check existence
+			if err != nil {
+				it.err = fmt.Errorf("failed to check existence of '%x': %v", it.k, err)
+				return
+			}
+		}
+
 		if !exists {
-			err = s3.Put(k[:], bytes.NewBuffer(it.chunk)) //if not exists put
+			obj, err := opts.Codec.Encode(pool.get(len(it.chunk) + opts.Codec.Overhead())[:0], it.chunk)
 			if err != nil {
-				it.resCh <- &result{fmt.Errorf("failed to put chunk '%x': %v", k, err), ZeroKey}
+				it.err = fmt.Errorf("failed to encode chunk '%x': %v", it.k, err)
 				return
 			}
+
+			err = s3.Put(ctx, it.k[:], obj) //if not exists put
+			stored := len(obj)
+			pool.put(obj)
+			if err != nil {
+				it.err = fmt.Errorf("failed to put chunk '%x': %v", it.k, err)
+				return
+			}
+
+			atomic.AddInt64(&st.Uploaded, 1)
+			atomic.AddInt64(&st.UploadedBytes, int64(len(it.chunk)))
+			atomic.AddInt64(&st.StoredBytes, int64(stored))
 		}
 
-		it.resCh <- &result{nil, k}
+		opts.Index.Add(it.k)
+	}
+
+	//fixed pool of workers
+	workCh := make(chan *item)
+	for i := 0; i < lim.Workers; i++ {
+		go func() {
+			for it := range workCh {
+				work(it)
+			}
+		}()
 	}
 
-	//fan out
-	itemCh := make(chan *item, concurrency)
+	//fan out, items are queued in stream order for the fan-in and handed to a worker
+	itemCh := make(chan *item, lim.Workers)
 	go func() {
 		defer close(itemCh)
+		defer close(workCh)
 		buf := make([]byte, chunker.MaxSize)
 		for {
-			var chunk chunker.Chunk
-			chunk, err = cr.Next(buf)
+			chunk, err := cr.Next(buf)
 			if err != nil {
 				if err != io.EOF {
-					itemCh <- &item{err: err}
+					select {
+					case itemCh <- &item{err: fmt.Errorf("failed to iterate: %v", err), done: closed}:
+					case <-ctx.Done():
+					}
 				}
 
-				break
+				return
 			}
 
-			it := &item{
-				chunk: make([]byte, chunk.Length),
-				resCh: make(chan *result),
+			if bud.acquire(ctx, int64(int(chunk.Length)+opts.Codec.encodeSize(int(chunk.Length)))) != nil {
+				return
 			}
 
+			atomic.AddInt64(&st.Chunks, 1)
+			atomic.AddInt64(&st.Bytes, int64(chunk.Length))
+
+			it := &item{chunk: pool.get(int(chunk.Length)), done: make(chan struct{})}
 			copy(it.chunk, chunk.Data) //underlying buffer is switched out
 
-			go work(it)  //create work
-			itemCh <- it //send to fan-in thread for syncing results
+			select {
+			case itemCh <- it: //send to fan-in thread for syncing results
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case workCh <- it: //create work
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	//fan-in
 	for it := range itemCh {
-		if it.err != nil {
-			return fmt.Errorf("failed to iterate: %v", it.err)
+		select {
+		case <-it.done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
-		res := <-it.resCh
-		if res.err != nil {
-			return res.err
+		if it.err != nil {
+			return it.err
 		}
 
-		err = kw.Write(res.k)
+		err = kw.Write(it.k)
 		if err != nil {
 			return fmt.Errorf("failed to write key: %v", err)
 		}
 	}
 
-	return nil
+	return ctx.Err()
 }